@@ -0,0 +1,182 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/observiq/go-msi/util"
+	"github.com/observiq/go-msi/wix"
+)
+
+// cacheVersion changes along with the way packages are built,
+// invalidating the cached packages.
+const cacheVersion = "1"
+
+// DefaultCacheDir returns the default directory of the build cache,
+// in the cache directory of the user.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-msi")
+}
+
+// cacheInputs is the part of the key of a build known before the
+// build files are written.
+type cacheInputs struct {
+	base     string   // directory the paths of the key are relative to
+	manifest []byte   // canonical manifest with the options applied
+	files    []string // license, banner, dialog and icon files
+}
+
+func newCacheInputs(wixFile *manifest.WixManifest) (*cacheInputs, error) {
+	base := wixFile.BaseDir
+	if base == "" {
+		base = "."
+	}
+	byt, err := wixFile.MarshalRelative(base)
+	if err != nil {
+		return nil, err
+	}
+	inputs := &cacheInputs{base: base, manifest: byt}
+	for _, f := range []string{wixFile.License, wixFile.Banner, wixFile.Dialog, wixFile.Icon} {
+		if f != "" {
+			inputs.files = append(inputs.files, f)
+		}
+	}
+	for _, lang := range wixFile.Languages {
+		if lang.License != "" {
+			inputs.files = append(inputs.files, lang.License)
+		}
+	}
+	return inputs, nil
+}
+
+// cacheKey hashes the inputs of the build, the toolset found in bin along
+// with its version, the templates of dir, the files of the package along
+// with their identifiers and the merge modules. The paths are relative to
+// the manifest, the key does not depend on the working directory.
+func cacheKey(inputs *cacheInputs, wixFile *manifest.WixManifest, fsys fs.FS, dir string, opts *Options, toolset wix.Toolset, bin string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "go-msi %s\n", cacheVersion)
+	fmt.Fprintf(h, "toolset %s %s\nbin %s\narch %s\nkind %s\nversion %s\ndisplay %s\nreproducible %t\n",
+		toolset, toolset.Version(bin), filepath.ToSlash(bin), opts.Arch, opts.Kind, wixFile.Version.User, wixFile.Version.Display, opts.Reproducible)
+	h.Write(inputs.manifest)
+	hashFile := func(kind, p string) error {
+		sum, err := util.ComputeSha256(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %s %s\n", kind, keyPath(inputs.base, p), sum)
+		return nil
+	}
+	for _, f := range inputs.files {
+		if err := hashFile("input", f); err != nil {
+			return "", err
+		}
+	}
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		tpl := path.Join(dir, e.Name())
+		content, err := fs.ReadFile(fsys, tpl)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "template %s %x\n", tpl, sha256.Sum256(content))
+	}
+	for _, file := range wixFile.AllFiles() {
+		fmt.Fprintf(h, "id %s %s\n", file.ID, file.GUID)
+		if err := hashFile("file", file.Path); err != nil {
+			return "", err
+		}
+	}
+	for _, module := range wixFile.MergeModules {
+		if err := hashFile("module", module.Path); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// keyPath returns the slash separated path of p relative to base.
+func keyPath(base, p string) string {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	abs, err := filepath.Abs(filepath.FromSlash(p))
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	rel, err := filepath.Rel(absBase, abs)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// templateKey completes the key of a build with the inputs of the
+// template functions, known once the templates are generated.
+func templateKey(key string, inputs []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", key)
+	for _, input := range inputs {
+		fmt.Fprintf(h, "%s\n", input)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachePath returns the path of the package of the culture cached under key.
+func cachePath(dir, key, culture string) string {
+	p := filepath.Join(dir, key+".msi")
+	if culture == "" {
+		return p
+	}
+	return wix.CultureOutFile(p, culture)
+}
+
+// loadCache copies the packages cached under key, if all of them are.
+func loadCache(dir, key string, pkgs []output) (bool, error) {
+	for _, pkg := range pkgs {
+		if _, err := os.Stat(cachePath(dir, key, pkg.culture)); err != nil {
+			return false, nil
+		}
+	}
+	for _, pkg := range pkgs {
+		if err := util.CopyFile(pkg.path, cachePath(dir, key, pkg.culture)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// storeCache copies the built packages into the cache.
+func storeCache(dir, key string, pkgs []output) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		dst := cachePath(dir, key, pkg.culture)
+		if err := util.CopyFile(dst+".tmp", pkg.path); err != nil {
+			os.Remove(dst + ".tmp")
+			return err
+		}
+		if err := os.Rename(dst+".tmp", dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
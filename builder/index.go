@@ -0,0 +1,584 @@
+// Package builder builds MSI packages from a wix.json manifest,
+// it is the library behind the make command.
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/observiq/go-msi/rtf"
+	"github.com/observiq/go-msi/sbom"
+	"github.com/observiq/go-msi/templates"
+	"github.com/observiq/go-msi/wix"
+)
+
+// Step names a step of the build.
+type Step string
+
+// The steps of the build, in order.
+const (
+	StepOptions   Step = "options"
+	StepLoad      Step = "load"
+	StepLicense   Step = "license"
+	StepNormalize Step = "normalize"
+	StepToolset   Step = "toolset"
+	StepLock      Step = "lock"
+	StepSbom      Step = "sbom"
+	StepCache     Step = "cache"
+	StepTemplates Step = "templates"
+	StepRun       Step = "run"
+	StepReport    Step = "report"
+	StepClean     Step = "clean"
+)
+
+// Error is the failure of a step of the build.
+type Error struct {
+	Step Step
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoTemplates is returned when the templates directory has no *.wxs file.
+var ErrNoTemplates = errors.New("No templates *.wxs found in this directory")
+
+// Options configures a build.
+type Options struct {
+	Path          string                // path of the manifest, wix.json if empty
+	Manifest      *manifest.WixManifest // used instead of loading Path when set, without lock file unless Path is set
+	BaseDir       string                // directory of the relative paths of the manifest, the one of Path if empty
+	DebugManifest bool                  // write the loaded manifest to wix.dynamic.json next to Path
+	Src           string                // directory of the templates overriding the embedded defaults
+	Out           string                // directory of the build files, a temporary directory if empty
+	Msi           string                // path of the resulting package
+	Version       string                // version of the program, replaces the one of the manifest when set
+	Display       string                // display version of the program, replaces the one of the manifest when set
+	License       string                // replaces the license of the manifest when set
+	Compression   string                // compression level of the package, replaces the one of the manifest when set
+	Properties    []string              // properties defined as Id=Value
+	Arch          string                // amd64 or 386
+	Kind          string                // product (default if empty) or module
+	Toolset       string                // wix3, wix4, wixl or auto (default if empty)
+	Bin           string                // directory of the WiX tools, PATH is used if empty
+	Keep          bool                  // keep the build files
+	CacheDir      string                // directory of the build cache, no cache if empty
+	Offline       bool                  // the download template function only reads the cache
+	Reproducible  bool                  // build the same package from the same inputs
+	UpdateLock    bool                  // accept the component rule violations and record them in the lock file
+	Sbom          string                // path of the software bill of materials, none if empty
+	SbomFormat    string                // cyclonedx (default if empty) or spdx
+	Report        string                // path of the build report, none if empty
+	DryRun        bool                  // generate and keep the build files without running the tools
+	Pretty        bool                  // pretty print the generated files
+	Validate      bool                  // check that the generated files are well formed
+	Output        io.Writer             // receives the messages and the output of the tools, discarded if nil
+}
+
+// Builder builds an MSI package.
+type Builder struct {
+	opts     Options
+	lockPath string
+	manifest *manifest.WixManifest
+	cached   bool
+	warnings []string
+	report   *Report
+	files    []string
+	commands []wix.Command
+}
+
+// New returns a builder of the given options.
+func New(opts Options) *Builder {
+	lockPath := ""
+	if opts.Manifest == nil || opts.Path != "" {
+		lockPath = LockPath(opts.Path)
+	}
+	if opts.Path == "" {
+		opts.Path = "wix.json"
+	}
+	if opts.Kind == "" {
+		opts.Kind = "product"
+	}
+	if opts.SbomFormat == "" {
+		opts.SbomFormat = "cyclonedx"
+	}
+	if opts.Output == nil {
+		opts.Output = ioutil.Discard
+	}
+	return &Builder{opts: opts, lockPath: lockPath}
+}
+
+// Out returns the directory of the build files.
+func (b *Builder) Out() string {
+	return b.opts.Out
+}
+
+// Manifest returns the manifest of the build, once loaded.
+func (b *Builder) Manifest() *manifest.WixManifest {
+	return b.manifest
+}
+
+// Build builds the package, the build stops at the first failed step
+// or when the context is done.
+func (b *Builder) Build(ctx context.Context) error {
+	opts := &b.opts
+	if opts.Msi == "" && !opts.DryRun {
+		return &Error{StepOptions, errors.New("--msi parameter must be set")}
+	}
+	if opts.Sbom != "" {
+		if err := sbom.CheckFormat(opts.SbomFormat); err != nil {
+			return &Error{StepOptions, err}
+		}
+	}
+
+	wixFile := opts.Manifest
+	if wixFile == nil {
+		wixFile = &manifest.WixManifest{BaseDir: opts.BaseDir}
+		if err := wixFile.Load(opts.Path); err != nil {
+			return &Error{StepLoad, err}
+		}
+	}
+	if opts.DebugManifest {
+		if err := wixFile.WriteDebug(opts.Path); err != nil {
+			return &Error{StepLoad, err}
+		}
+	}
+	b.manifest = wixFile
+	if _, err := wixFile.SetGuids(false); err != nil {
+		return &Error{StepLoad, err}
+	}
+
+	var err error
+	if opts.Out == "" {
+		if opts.Out, err = ioutil.TempDir("", "go-msi"); err != nil {
+			return &Error{StepOptions, err}
+		}
+	}
+	if opts.Out, err = filepath.Abs(opts.Out); err != nil {
+		return &Error{StepOptions, err}
+	}
+	if err := os.RemoveAll(opts.Out); err != nil {
+		return &Error{StepOptions, err}
+	}
+	if err := os.MkdirAll(opts.Out, 0744); err != nil {
+		return &Error{StepOptions, err}
+	}
+
+	wixFile.Kind = opts.Kind
+	if opts.Compression != "" {
+		wixFile.Compression = opts.Compression
+	}
+	if opts.Version != "" {
+		wixFile.Version.User = opts.Version
+	}
+	if opts.Display != "" {
+		wixFile.Version.Display = opts.Display
+	}
+
+	if opts.License != "" {
+		wixFile.License = opts.License
+	}
+	if err := AddProperties(wixFile, opts.Properties); err != nil {
+		return &Error{StepNormalize, err}
+	}
+
+	var inputs *cacheInputs
+	if opts.CacheDir != "" && !opts.DryRun {
+		if inputs, err = newCacheInputs(wixFile); err != nil {
+			return &Error{StepCache, err}
+		}
+	}
+
+	if err := ConvertLicense(wixFile, opts.Out, opts.Output); err != nil {
+		return &Error{StepLicense, err}
+	}
+	if err := wixFile.Normalize(); err != nil {
+		return &Error{StepNormalize, err}
+	}
+
+	bin := opts.Bin
+	if bin != "" {
+		if bin, err = filepath.Abs(bin); err != nil {
+			return &Error{StepToolset, err}
+		}
+	}
+	toolset, err := wix.SelectToolset(opts.Toolset, bin)
+	if err != nil {
+		return &Error{StepToolset, err}
+	}
+	if err := toolset.Check(wixFile); err != nil {
+		return &Error{StepToolset, err}
+	}
+	if opts.Reproducible && !opts.DryRun {
+		if err := toolset.CheckReproducible(); err != nil {
+			return &Error{StepToolset, err}
+		}
+	}
+
+	var epoch time.Time
+	if opts.Reproducible {
+		if epoch, err = SourceDateEpoch(); err != nil {
+			return &Error{StepOptions, err}
+		}
+		wixFile.SortFiles()
+		if err := wixFile.SetReproducibleCodes(opts.Arch); err != nil {
+			return &Error{StepNormalize, err}
+		}
+	}
+
+	if b.lockPath != "" {
+		if b.warnings, err = lockFiles(wixFile, b.lockPath, opts.Output, !opts.DryRun, opts.UpdateLock); err != nil {
+			return &Error{StepLock, err}
+		}
+	} else if err := wixFile.AssignIDs(); err != nil {
+		return &Error{StepLock, err}
+	}
+
+	if opts.Sbom != "" {
+		created := time.Now()
+		if opts.Reproducible {
+			created = epoch
+		}
+		s, err := sbom.New(wixFile, created)
+		if err != nil {
+			return &Error{StepSbom, err}
+		}
+		if err := s.WriteFile(opts.Sbom, opts.SbomFormat); err != nil {
+			return &Error{StepSbom, err}
+		}
+	}
+
+	fsys, err := templates.Overlay(opts.Src, "")
+	if err != nil {
+		return &Error{StepTemplates, err}
+	}
+	dir := TemplatesDir(opts.Kind, toolset)
+	tpls, err := templates.Find(fsys, dir, "*.wxs")
+	if err != nil {
+		return &Error{StepTemplates, err}
+	}
+	if len(tpls) == 0 {
+		return &Error{StepTemplates, ErrNoTemplates}
+	}
+
+	if opts.Msi == "" {
+		opts.Msi = filepath.Join(opts.Out, "package.msi")
+	}
+	msi, err := filepath.Abs(opts.Msi)
+	if err != nil {
+		return &Error{StepOptions, err}
+	}
+
+	// the key is completed by the inputs of the template functions
+	var key string
+	var tplInputs []string
+	tplOpts := templates.Options{CacheDir: opts.CacheDir, Offline: opts.Offline}
+	if inputs != nil {
+		if key, err = cacheKey(inputs, wixFile, fsys, dir, opts, toolset, bin); err != nil {
+			return &Error{StepCache, err}
+		}
+		tplOpts.Inputs = func(fn, arg, sum string) {
+			tplInputs = append(tplInputs, fmt.Sprintf("%s %s %s", fn, arg, sum))
+		}
+	}
+
+	if opts.Reproducible {
+		if err := wixFile.StageFiles(filepath.Join(opts.Out, "files"), epoch); err != nil {
+			return &Error{StepTemplates, err}
+		}
+	}
+	if err := wixFile.RewriteFilePaths(opts.Out); err != nil {
+		return &Error{StepTemplates, err}
+	}
+	if err := ctx.Err(); err != nil {
+		return &Error{StepTemplates, err}
+	}
+
+	builtTemplates := make([]string, len(tpls))
+	for i, tpl := range tpls {
+		dst := filepath.Join(opts.Out, path.Base(tpl))
+		builtTemplates[i] = dst
+		if err := templates.GenerateTemplate(wixFile, fsys, tpl, dst, tplOpts); err != nil {
+			return &Error{StepTemplates, err}
+		}
+	}
+	locs, err := wix.GenerateLocalizations(wixFile, opts.Out)
+	if err != nil {
+		return &Error{StepTemplates, err}
+	}
+	b.files = append(builtTemplates, locs...)
+	if err := b.checkFiles(); err != nil {
+		return &Error{StepTemplates, err}
+	}
+
+	if key != "" {
+		key = templateKey(key, tplInputs)
+		if b.cached, err = loadCache(opts.CacheDir, key, outputs(wixFile, msi)); err != nil {
+			return &Error{StepCache, err}
+		}
+		if b.cached {
+			fmt.Fprintf(opts.Output, "Nothing changed, using the cached package %s\n", cachePath(opts.CacheDir, key, ""))
+			return b.finish(wixFile, toolset, msi)
+		}
+	}
+
+	rel, err := filepath.Rel(opts.Out, msi)
+	if err != nil {
+		return &Error{StepRun, err}
+	}
+
+	cmds := toolset.GenerateCmd(wixFile, builtTemplates, rel, opts.Arch, bin)
+	if opts.Reproducible {
+		cmds = toolset.ReproducibleCmd(wixFile, cmds, rel, epoch)
+	}
+	b.commands = cmds
+	if opts.DryRun {
+		return nil
+	}
+	if err := wix.Run(ctx, cmds, opts.Out, opts.Output); err != nil {
+		return &Error{StepRun, err}
+	}
+
+	if key != "" {
+		if err := storeCache(opts.CacheDir, key, outputs(wixFile, msi)); err != nil {
+			return &Error{StepCache, err}
+		}
+	}
+	return b.finish(wixFile, toolset, msi)
+}
+
+// checkFiles pretty prints and validates the generated files as requested.
+func (b *Builder) checkFiles() error {
+	if !b.opts.Pretty && !b.opts.Validate {
+		return nil
+	}
+	for _, f := range b.files {
+		byt, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if b.opts.Validate {
+			if err := wix.ValidateXML(byt); err != nil {
+				return fmt.Errorf("%s: %v", filepath.Base(f), err)
+			}
+		}
+		if b.opts.Pretty {
+			if byt, err = wix.FormatXML(byt); err != nil {
+				return fmt.Errorf("%s: %v", filepath.Base(f), err)
+			}
+			if err := ioutil.WriteFile(f, byt, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Files returns the generated WiX sources and localization files,
+// once built.
+func (b *Builder) Files() []string {
+	return b.files
+}
+
+// Commands returns the commands of the WiX tools, once built.
+func (b *Builder) Commands() []wix.Command {
+	return b.commands
+}
+
+// finish reports the build and removes the build files.
+func (b *Builder) finish(wixFile *manifest.WixManifest, toolset wix.Toolset, msi string) error {
+	report, err := newReport(wixFile, toolset, msi, b)
+	if err != nil {
+		return &Error{StepReport, err}
+	}
+	b.report = report
+	if b.opts.Report != "" {
+		if err := report.WriteFile(b.opts.Report); err != nil {
+			return &Error{StepReport, err}
+		}
+	}
+	return b.clean()
+}
+
+// Report returns the report of the build, once built.
+func (b *Builder) Report() *Report {
+	return b.report
+}
+
+// output is a package produced by the build.
+type output struct {
+	culture string
+	path    string
+}
+
+// outputs returns the packages produced by the build, one per culture
+// when the manifest is localized.
+func outputs(wixFile *manifest.WixManifest, msi string) []output {
+	if len(wixFile.Languages) == 0 {
+		return []output{{"", msi}}
+	}
+	var outs []output
+	for _, lang := range wixFile.Languages {
+		outs = append(outs, output{lang.Culture, wix.CultureOutFile(msi, lang.Culture)})
+	}
+	return outs
+}
+
+// Cached tells whether the package was taken from the cache,
+// once built.
+func (b *Builder) Cached() bool {
+	return b.cached
+}
+
+func (b *Builder) clean() error {
+	if b.opts.Keep {
+		return nil
+	}
+	if err := os.RemoveAll(b.opts.Out); err != nil {
+		return &Error{StepClean, err}
+	}
+	return nil
+}
+
+// SourceDateEpoch returns the date of the SOURCE_DATE_EPOCH variable used by
+// reproducible builds, 1980-01-01 when not set as cabinets can not store
+// earlier dates.
+func SourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf(`Invalid "SOURCE_DATE_EPOCH" value: %s`, v)
+	}
+	return time.Unix(n, 0).UTC(), nil
+}
+
+// TemplatesDir returns the sub directory of the templates for the given
+// kind of package and toolset, merge module templates live in the module
+// sub directory, wixl templates in the wixl sub directory.
+func TemplatesDir(kind string, toolset wix.Toolset) string {
+	if kind == "module" {
+		return "module"
+	}
+	if toolset == wix.Wixl {
+		return "wixl"
+	}
+	return "."
+}
+
+// AddProperties adds the properties defined as Id=Value to the manifest.
+func AddProperties(wixFile *manifest.WixManifest, properties []string) error {
+	for _, prop := range properties {
+		s := strings.SplitN(prop, "=", 2)
+		if len(s) < 2 {
+			return fmt.Errorf("property definition must be of the form Id=Value")
+		}
+		v := manifest.Value(s[1])
+		wixFile.Properties = append(wixFile.Properties,
+			manifest.Property{
+				ID:    s[0],
+				Value: &v,
+			},
+		)
+	}
+	return nil
+}
+
+// LockPath returns the path of the lock file of the manifest p,
+// wix.lock next to it.
+func LockPath(p string) string {
+	if p == "" {
+		p = "wix.json"
+	}
+	return filepath.Join(filepath.Dir(p), "wix.lock")
+}
+
+// LockFiles gives the files the identifiers recorded in the lock file of
+// the manifest path and records the new ones. It fails if the manifest
+// violates the component rules since the locked release, unless update
+// accepts the violations, which are then returned as warnings.
+func LockFiles(wixFile *manifest.WixManifest, path string, w io.Writer, update bool) ([]string, error) {
+	return lockFiles(wixFile, LockPath(path), w, true, update)
+}
+
+func lockFiles(wixFile *manifest.WixManifest, lockPath string, w io.Writer, save, update bool) ([]string, error) {
+	lock, err := manifest.LoadLock(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	newLock, violations, err := wixFile.ApplyLock(lock)
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) > 0 && !update {
+		return nil, fmt.Errorf("component rules violated since the release recorded in %s:\n- %s\nrestore the files or accept the changes with --update-lock",
+			lockPath, strings.Join(violations, "\n- "))
+	}
+	var warnings []string
+	for _, v := range violations {
+		warning := "component rule violation, " + v
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+		warnings = append(warnings, warning)
+	}
+	if !save {
+		return warnings, nil
+	}
+	return warnings, newLock.Save(lockPath)
+}
+
+// ConvertLicense converts the licenses of the manifest to RTF into out.
+func ConvertLicense(wixFile *manifest.WixManifest, out string, w io.Writer) error {
+	var err error
+	if wixFile.License, err = toRtfLicense(wixFile.License, "", out, w); err != nil {
+		return err
+	}
+	for i, lang := range wixFile.Languages {
+		if wixFile.Languages[i].License, err = toRtfLicense(lang.License, lang.Culture, out, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toRtfLicense(license, culture, out string, w io.Writer) (string, error) {
+	if license == "" {
+		return license, nil
+	}
+	isRtf, err := rtf.IsRtf(license)
+	if err != nil {
+		return license, err
+	}
+	if isRtf {
+		return license, nil
+	}
+	name := filepath.Base(license) + ".rtf"
+	if culture != "" {
+		fmt.Fprintf(w, "Converting %s license to RTF\n", culture)
+		name = culture + "." + name
+	} else {
+		fmt.Fprintln(w, "Converting license to RTF")
+	}
+	target := filepath.Join(out, name)
+	if err := rtf.WriteAsRtf(license, target, true); err != nil {
+		return license, err
+	}
+	return target, nil
+}
@@ -0,0 +1,210 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildErrors(t *testing.T) {
+	var berr *Error
+
+	err := New(Options{}).Build(context.Background())
+	require.True(t, errors.As(err, &berr))
+	require.Equal(t, StepOptions, berr.Step)
+
+	err = New(Options{
+		Path: filepath.Join(t.TempDir(), "wix.json"),
+		Msi:  "hello.msi",
+	}).Build(context.Background())
+	require.True(t, errors.As(err, &berr))
+	require.Equal(t, StepLoad, berr.Step)
+}
+
+func TestBuildCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the wixl stub is a shell script")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	require.NoError(t, os.Mkdir(bin, 0755))
+	version := filepath.Join(dir, "version")
+	require.NoError(t, ioutil.WriteFile(version, []byte("0.101\n"), 0644))
+	stub := "#!/bin/sh\nif [ \"$1\" = --version ]; then cat " + version + "; exit 0; fi\n" +
+		"echo run >> " + filepath.Join(dir, "runs") + "\necho msi > \"$2\"\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bin, "wixl"), []byte(stub), 0755))
+	hello := filepath.Join(dir, "hello.exe")
+	require.NoError(t, ioutil.WriteFile(hello, []byte("hello"), 0644))
+	// a partial reading a file with the cat template function
+	note := filepath.Join(dir, "note.txt")
+	require.NoError(t, ioutil.WriteFile(note, []byte("note"), 0644))
+	src := filepath.Join(dir, "templates")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "wixl"), 0755))
+	partial := `{{define "CONDITIONS"}}<!-- {{cat "` + filepath.ToSlash(note) + `"}} -->{{end}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "wixl", "note.tmpl"), []byte(partial), 0644))
+
+	build := func() *Builder {
+		wixFile, err := manifest.NewBuilder("hello", "acme", "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}").
+			Version("1.0.0").
+			AddFile("", manifest.File{Path: hello}).
+			Build()
+		require.NoError(t, err)
+		b := New(Options{
+			Path:     filepath.Join(dir, "wix.json"),
+			Manifest: wixFile,
+			Src:      src,
+			Msi:      filepath.Join(dir, "hello.msi"),
+			Toolset:  "wixl",
+			Bin:      bin,
+			CacheDir: filepath.Join(dir, "cache"),
+			Report:   filepath.Join(dir, "build.json"),
+		})
+		require.NoError(t, b.Build(context.Background()))
+		return b
+	}
+	runs := func() int {
+		byt, err := ioutil.ReadFile(filepath.Join(dir, "runs"))
+		require.NoError(t, err)
+		return strings.Count(string(byt), "run")
+	}
+
+	b := build()
+	require.False(t, b.Cached())
+	require.Equal(t, 1, b.Report().FileCount)
+	require.Equal(t, int64(4), b.Report().Packages[0].Size)
+	require.True(t, build().Cached())
+	require.Equal(t, 1, runs())
+
+	byt, err := ioutil.ReadFile(filepath.Join(dir, "build.json"))
+	require.NoError(t, err)
+	var report Report
+	require.NoError(t, json.Unmarshal(byt, &report))
+	require.Equal(t, ReportSchema, report.Schema)
+	require.Equal(t, "1.0.0", report.MsiVersion)
+	require.True(t, report.Cached)
+
+	require.NoError(t, ioutil.WriteFile(hello, []byte("hello world"), 0644))
+	require.False(t, build().Cached())
+	require.Equal(t, 2, runs())
+
+	require.NoError(t, ioutil.WriteFile(note, []byte("changed"), 0644))
+	require.False(t, build().Cached())
+	require.True(t, build().Cached())
+	require.Equal(t, 3, runs())
+
+	require.NoError(t, ioutil.WriteFile(version, []byte("0.102\n"), 0644))
+	require.False(t, build().Cached())
+	require.Equal(t, 4, runs())
+}
+
+func TestKeyPath(t *testing.T) {
+	require.Equal(t, "../build/hello.exe", keyPath("packaging", "build/hello.exe"))
+	require.Equal(t, "hello.exe", keyPath("packaging", "packaging/hello.exe"))
+}
+
+func TestLockFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.exe", "b.exe"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	release := func(name string) *manifest.WixManifest {
+		wixFile := &manifest.WixManifest{}
+		wixFile.Files = []manifest.File{{Path: filepath.Join(dir, name)}}
+		return wixFile
+	}
+	lockPath := LockPath(filepath.Join(dir, "wix.json"))
+	var out strings.Builder
+
+	_, err := lockFiles(release("a.exe"), lockPath, &out, false, false)
+	require.NoError(t, err)
+	require.NoFileExists(t, lockPath)
+
+	_, err = lockFiles(release("a.exe"), lockPath, &out, true, false)
+	require.NoError(t, err)
+	locked, err := ioutil.ReadFile(lockPath)
+	require.NoError(t, err)
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(lockPath, old, old))
+	_, err = lockFiles(release("a.exe"), lockPath, &out, true, false)
+	require.NoError(t, err)
+	info, err := os.Stat(lockPath)
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(old), "an up to date lock file is not written")
+
+	_, err = lockFiles(release("b.exe"), lockPath, &out, true, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--update-lock")
+	byt, err := ioutil.ReadFile(lockPath)
+	require.NoError(t, err)
+	require.Equal(t, string(locked), string(byt))
+	require.Empty(t, out.String())
+
+	warnings, err := lockFiles(release("b.exe"), lockPath, &out, true, true)
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	require.Contains(t, out.String(), "Warning: component rule violation")
+	byt, err = ioutil.ReadFile(lockPath)
+	require.NoError(t, err)
+	require.Contains(t, string(byt), `"b.exe"`)
+
+	require.Empty(t, New(Options{Manifest: release("a.exe")}).lockPath)
+	require.Equal(t, lockPath, New(Options{Path: filepath.Join(dir, "wix.json"), Manifest: release("a.exe")}).lockPath)
+}
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestRenderGolden(t *testing.T) {
+	dir := filepath.Join("testdata", "render")
+	out := filepath.Join(dir, "out")
+	t.Cleanup(func() { os.RemoveAll(out) })
+	b := New(Options{
+		Path:     filepath.Join(dir, "wix.json"),
+		Out:      out,
+		Version:  "1.0.0",
+		Arch:     "amd64",
+		Toolset:  "wix3",
+		DryRun:   true,
+		Pretty:   true,
+		Validate: true,
+	})
+	require.NoError(t, b.Build(context.Background()))
+
+	var cmds []string
+	for _, cmd := range b.Commands() {
+		cmds = append(cmds, cmd.String())
+	}
+	files := map[string]string{"commands.txt": strings.Join(cmds, "\n") + "\n"}
+	for _, f := range b.Files() {
+		byt, err := ioutil.ReadFile(f)
+		require.NoError(t, err)
+		files[filepath.Base(f)] = string(byt)
+	}
+
+	golden := filepath.Join(dir, "golden")
+	if *update {
+		require.NoError(t, os.RemoveAll(golden))
+		require.NoError(t, os.MkdirAll(golden, 0755))
+		for name, content := range files {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(golden, name), []byte(content), 0644))
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(golden, "*"))
+	require.NoError(t, err)
+	require.Len(t, names, len(files))
+	for name, content := range files {
+		expected, err := ioutil.ReadFile(filepath.Join(golden, name))
+		require.NoError(t, err)
+		require.Equal(t, string(expected), content, name)
+	}
+}
@@ -0,0 +1,122 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/observiq/go-msi/util"
+	"github.com/observiq/go-msi/wix"
+)
+
+// ReportSchema is the version of the schema of the build report, it only
+// changes when a field is removed or changes of meaning.
+const ReportSchema = 1
+
+// Report describes a successful build.
+type Report struct {
+	Schema        int             `json:"schema"`
+	Product       string          `json:"product"`
+	Company       string          `json:"company"`
+	Version       string          `json:"version"`
+	MsiVersion    string          `json:"msi-version"`
+	VersionHex    int64           `json:"version-hex"`
+	UpgradeCode   string          `json:"upgrade-code"`
+	ProductCode   string          `json:"product-code,omitempty"` // when fixed or reproducible
+	Toolset       string          `json:"toolset"`
+	Cached        bool            `json:"cached"`
+	Packages      []ReportPackage `json:"packages"`
+	InstalledSize int64           `json:"installed-size"` // in kilobytes
+	FileCount     int             `json:"file-count"`
+	Services      []ReportService `json:"services"`
+	Sbom          string          `json:"sbom,omitempty"`
+	Warnings      []string        `json:"warnings"`
+}
+
+// ReportPackage is a package produced by the build,
+// one per culture when the manifest is localized.
+type ReportPackage struct {
+	Path        string `json:"path"`
+	Culture     string `json:"culture,omitempty"`
+	PackageCode string `json:"package-code,omitempty"` // when reproducible
+	Sha256      string `json:"sha256"`
+	Size        int64  `json:"size"` // in bytes
+}
+
+// ReportService is a service installed by the package.
+type ReportService struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display-name,omitempty"`
+	Start       string `json:"start"`
+	Delayed     bool   `json:"delayed"`
+	File        string `json:"file"` // install path of the executable
+}
+
+func newReport(wixFile *manifest.WixManifest, toolset wix.Toolset, msi string, b *Builder) (*Report, error) {
+	r := &Report{
+		Schema:      ReportSchema,
+		Product:     wixFile.Product,
+		Company:     wixFile.Company,
+		Version:     wixFile.Version.User,
+		MsiVersion:  wixFile.Version.MSI,
+		VersionHex:  wixFile.Version.Hex,
+		UpgradeCode: wixFile.UpgradeCode,
+		ProductCode: wixFile.ProductCode,
+		Toolset:     string(toolset),
+		Cached:      b.cached,
+		Packages:    []ReportPackage{},
+		Services:    []ReportService{},
+		Sbom:        b.opts.Sbom,
+		Warnings:    b.warnings,
+	}
+	if r.Warnings == nil {
+		r.Warnings = []string{}
+	}
+	if wixFile.Info != nil {
+		r.InstalledSize = wixFile.Info.Size
+	}
+	for _, out := range outputs(wixFile, msi) {
+		info, err := os.Stat(out.path)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := util.ComputeSha256(out.path)
+		if err != nil {
+			return nil, err
+		}
+		code := wixFile.PackageCode
+		if out.culture != "" {
+			code = wix.CulturePackageCode(code, out.culture)
+		}
+		r.Packages = append(r.Packages, ReportPackage{
+			Path:        out.path,
+			Culture:     out.culture,
+			PackageCode: code,
+			Sha256:      sum,
+			Size:        info.Size(),
+		})
+	}
+	for _, file := range wixFile.AllFiles() {
+		r.FileCount++
+		if s := file.Service; s != nil {
+			r.Services = append(r.Services, ReportService{
+				Name:        s.Name,
+				DisplayName: s.DisplayName,
+				Start:       s.Start,
+				Delayed:     s.Delayed,
+				File:        file.InstallPath,
+			})
+		}
+	}
+	return r, nil
+}
+
+// WriteFile writes the report as JSON to the p file.
+func (r *Report) WriteFile(p string) error {
+	byt, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, append(byt, '\n'), 0644)
+}
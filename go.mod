@@ -1,6 +1,6 @@
 module github.com/observiq/go-msi
 
-go 1.17
+go 1.18
 
 require (
 	github.com/Masterminds/semver v1.4.2
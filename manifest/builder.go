@@ -0,0 +1,190 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Builder constructs a manifest in code instead of loading a wix.json file.
+// The first error met while building is returned by Validate and Build.
+type Builder struct {
+	wixFile WixManifest
+	err     error
+}
+
+// NewBuilder returns a builder of a product manifest.
+func NewBuilder(product, company, upgradeCode string) *Builder {
+	return &Builder{wixFile: WixManifest{
+		Product:     product,
+		Company:     company,
+		UpgradeCode: upgradeCode,
+	}}
+}
+
+// Version sets the version of the product.
+func (b *Builder) Version(version string) *Builder {
+	b.wixFile.Version.User = version
+	return b
+}
+
+// License sets the license file of the product.
+func (b *Builder) License(license string) *Builder {
+	b.wixFile.License = license
+	return b
+}
+
+// Info sets the control panel program information.
+func (b *Builder) Info(info Info) *Builder {
+	b.wixFile.Info = &info
+	return b
+}
+
+// AddFile adds a file to the dir install directory, a slash separated path
+// relative to the install directory, missing directories are created.
+func (b *Builder) AddFile(dir string, file File) *Builder {
+	if file.Path == "" {
+		return b.fail(fmt.Errorf(`Missing "path" value in file`))
+	}
+	var names []string
+	if dir != "" && dir != "." {
+		if path.IsAbs(dir) || strings.Contains(dir, `\`) {
+			return b.fail(fmt.Errorf(`Invalid "dir" value in file: %s`, dir))
+		}
+		for _, name := range strings.Split(path.Clean(dir), "/") {
+			if name == ".." {
+				return b.fail(fmt.Errorf(`Invalid "dir" value in file: %s`, dir))
+			}
+			names = append(names, name)
+		}
+	}
+	d := &b.wixFile.Directory
+	for _, name := range names {
+		d = subDirectory(d, name)
+	}
+	for _, f := range d.Files {
+		if f.Path == file.Path {
+			return b.fail(fmt.Errorf(`Duplicated "path" value in file: %s`, file.Path))
+		}
+	}
+	d.Files = append(d.Files, file)
+	return b
+}
+
+func subDirectory(dir *Directory, name string) *Directory {
+	for i := range dir.Directories {
+		if dir.Directories[i].Name == name {
+			return &dir.Directories[i]
+		}
+	}
+	dir.Directories = append(dir.Directories, Directory{Name: name})
+	return &dir.Directories[len(dir.Directories)-1]
+}
+
+// AddService adds the executable file running the service to the dir
+// install directory.
+func (b *Builder) AddService(dir, file string, service Service) *Builder {
+	return b.AddFile(dir, File{Path: file, Service: &service})
+}
+
+// AddShortcut adds a shortcut.
+func (b *Builder) AddShortcut(shortcut Shortcut) *Builder {
+	b.wixFile.Shortcuts = append(b.wixFile.Shortcuts, shortcut)
+	return b
+}
+
+// AddRegistry adds a registry key and its values.
+func (b *Builder) AddRegistry(registry RegistryItem) *Builder {
+	b.wixFile.Registries = append(b.wixFile.Registries, registry)
+	return b
+}
+
+// AddHook adds a command run on install or uninstall.
+func (b *Builder) AddHook(hook Hook) *Builder {
+	b.wixFile.Hooks = append(b.wixFile.Hooks, hook)
+	return b
+}
+
+// AddProperty adds a property initialized to value.
+func (b *Builder) AddProperty(id, value string) *Builder {
+	v := Value(value)
+	b.wixFile.Properties = append(b.wixFile.Properties, Property{ID: id, Value: &v})
+	return b
+}
+
+// AddRegistryProperty adds a property initialized from the registry.
+func (b *Builder) AddRegistryProperty(id string, registry Registry) *Builder {
+	b.wixFile.Properties = append(b.wixFile.Properties, Property{ID: id, Registry: &registry})
+	return b
+}
+
+// AddEnvironment adds an environment variable.
+func (b *Builder) AddEnvironment(env Environment) *Builder {
+	b.wixFile.Environments = append(b.wixFile.Environments, env)
+	return b
+}
+
+// AddCondition adds a condition checked before installation.
+func (b *Builder) AddCondition(condition Condition) *Builder {
+	b.wixFile.Conditions = append(b.wixFile.Conditions, condition)
+	return b
+}
+
+// Edit lets f change the parts of the manifest without dedicated methods.
+func (b *Builder) Edit(f func(wixFile *WixManifest)) *Builder {
+	f(&b.wixFile)
+	return b
+}
+
+func (b *Builder) fail(err error) *Builder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+// Validate checks the manifest as Normalize does, without changing it.
+func (b *Builder) Validate() error {
+	if b.err != nil {
+		return b.err
+	}
+	wixFile, err := b.wixFile.clone()
+	if err != nil {
+		return err
+	}
+	return wixFile.Normalize()
+}
+
+// Build validates the manifest and returns a copy of it, as Load would
+// have decoded it from a wix.json file.
+func (b *Builder) Build() (*WixManifest, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	return b.wixFile.clone()
+}
+
+// Write validates the manifest and writes it to the given wix.json file.
+func (b *Builder) Write(p string) error {
+	wixFile, err := b.Build()
+	if err != nil {
+		return err
+	}
+	return wixFile.Write(p)
+}
+
+// clone returns a deep copy of the manifest.
+func (wixFile *WixManifest) clone() (*WixManifest, error) {
+	byt, err := json.Marshal(wixFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &WixManifest{}
+	if err := json.Unmarshal(byt, c); err != nil {
+		return nil, err
+	}
+	c.Kind = wixFile.Kind
+	c.Version = wixFile.Version
+	return c, nil
+}
@@ -0,0 +1,123 @@
+package manifest
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// AddFile lists file in the sub directory of dir made of the names of
+// dirs, created as needed. It returns false if the file is already
+// listed there.
+func (dir *Directory) AddFile(file File, dirs []string) bool {
+	if len(dirs) == 0 {
+		for _, f := range dir.Files {
+			if samePath(f.Path, file.Path) {
+				return false
+			}
+		}
+		dir.Files = append(dir.Files, file)
+		return true
+	}
+	for i := range dir.Directories {
+		if dir.Directories[i].Name == dirs[0] {
+			return dir.Directories[i].AddFile(file, dirs[1:])
+		}
+	}
+	dir.Directories = append(dir.Directories, Directory{Name: dirs[0]})
+	return dir.Directories[len(dir.Directories)-1].AddFile(file, dirs[1:])
+}
+
+// RemoveFiles removes the listed files for which remove returns true,
+// along with the sub directories they leave empty, and returns them.
+func (dir *Directory) RemoveFiles(remove func(file File) bool) []File {
+	removed := []File{}
+	files := dir.Files[:0]
+	for _, file := range dir.Files {
+		if remove(file) {
+			removed = append(removed, file)
+			continue
+		}
+		files = append(files, file)
+	}
+	dir.Files = files
+
+	dirs := dir.Directories[:0]
+	for _, sub := range dir.Directories {
+		r := sub.RemoveFiles(remove)
+		removed = append(removed, r...)
+		if len(r) > 0 && sub.empty() {
+			continue
+		}
+		dirs = append(dirs, sub)
+	}
+	dir.Directories = dirs
+	return removed
+}
+
+// empty tells whether the directory lists nothing and discovers nothing
+// of its own.
+func (dir *Directory) empty() bool {
+	return len(dir.Files) == 0 && len(dir.Directories) == 0 &&
+		len(dir.Include) == 0 && len(dir.Exclude) == 0 && len(dir.Rules) == 0
+}
+
+// SyncFiles reconciles the files listed under the src directory with
+// found, the slash separated paths relative to src of the files to list.
+// The missing files are added to the sub directories of their path, the
+// listed files not found are removed, the others keep their settings.
+func (wixFile *WixManifest) SyncFiles(src string, found []string) (added, removed []File) {
+	want := map[string]bool{}
+	for _, f := range found {
+		want[absPath(path.Join(filepath.ToSlash(src), f))] = true
+	}
+	listed := map[string]bool{}
+	wixFile.walkFiles(func(file File) (File, error) {
+		listed[absPath(file.Path)] = true
+		return file, nil
+	})
+	added = []File{}
+	for _, f := range found {
+		file := File{Path: path.Join(filepath.ToSlash(src), f)}
+		if listed[absPath(file.Path)] {
+			continue
+		}
+		dirs := []string{}
+		if d := path.Dir(f); d != "." {
+			dirs = strings.Split(d, "/")
+		}
+		if wixFile.AddFile(file, dirs) {
+			listed[absPath(file.Path)] = true
+			added = append(added, file)
+		}
+	}
+
+	// removed last to keep the directories whose files are replaced
+	removed = wixFile.RemoveFiles(func(file File) bool {
+		_, ok := RelPath(src, file.Path)
+		return ok && !want[absPath(file.Path)]
+	})
+	return added, removed
+}
+
+// RelPath returns the slash separated path of p relative to the dir
+// directory, false if p is out of it.
+func RelPath(dir, p string) (string, bool) {
+	rel, err := filepath.Rel(absPath(dir), absPath(p))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func absPath(p string) string {
+	abs, err := filepath.Abs(filepath.FromSlash(p))
+	if err != nil {
+		return filepath.Clean(filepath.FromSlash(p))
+	}
+	return abs
+}
+
+func samePath(a, b string) bool {
+	return absPath(a) == absPath(b)
+}
@@ -1,24 +1,27 @@
 package manifest
 
 import (
-	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
-	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/Masterminds/semver"
+	"github.com/bmatcuk/doublestar"
 	"github.com/google/uuid"
 )
 
 // WixManifest is the struct to decode a wix.json file.
 type WixManifest struct {
 	Compression string  `json:"compression,omitempty"`
+	Kind        string  `json:"-"` // product (default if omitted) or module
 	Product     string  `json:"product"`
 	Company     string  `json:"company"`
 	Version     Version `json:"-"`
@@ -28,6 +31,9 @@ type WixManifest struct {
 	Icon        string  `json:"icon,omitempty"`
 	Info        *Info   `json:"info,omitempty"`
 	UpgradeCode string  `json:"upgrade-code"`
+	ProductCode string  `json:"product-code,omitempty"`
+	ModuleCode  string  `json:"module-code,omitempty"` // package guid of the merge module, derived from the upgrade code if empty
+	PackageCode string  `json:"-"`                     // generated by the toolset if empty
 	Directory
 	Environments []Environment  `json:"environments,omitempty"`
 	Registries   []RegistryItem `json:"registries,omitempty"`
@@ -36,6 +42,15 @@ type WixManifest struct {
 	Hooks        []Hook         `json:"hooks,omitempty"`
 	Properties   []Property     `json:"properties,omitempty"`
 	Conditions   []Condition    `json:"conditions,omitempty"`
+	Bundle       *Bundle        `json:"bundle,omitempty"`
+	Features     []Feature      `json:"features,omitempty"`
+	MergeModules []MergeModule  `json:"merge-modules,omitempty"`
+	Languages    []Language     `json:"languages,omitempty"`
+	Dialogs      []Dialog       `json:"dialogs,omitempty"`
+	UI           *UI            `json:"ui,omitempty"`
+	Patch        *Patch         `json:"patch,omitempty"`
+	Upgrade      *Upgrade       `json:"upgrade,omitempty"`
+	BaseDir      string         `json:"-"` // directory of the relative paths, the one of the manifest file if empty
 }
 
 // Version stores version related data in various formats.
@@ -62,19 +77,39 @@ type Info struct {
 
 // File is the struct to decode a file.
 type File struct {
-	ID             int      `json:"-"`
+	ID             string   `json:"-"`
 	Path           string   `json:"path,omitempty"`
 	Service        *Service `json:"service,omitempty"`
 	NeverOverwrite bool     `json:"never_overwrite,omitempty"`
 	Permanent      bool     `json:"permanent,omitempty"`
+	Feature        string   `json:"feature,omitempty"`
+	InstallPath    string   `json:"-"` // relative to the install directory
+	GUID           string   `json:"-"` // of the file component
 }
 
 // Directory stores a list of files and a list of sub-directories.
+// The content of the directories of the manifest is discovered, the
+// patterns of Include, Exclude and Rules are relative to them.
 type Directory struct {
-	ID          int         `json:"-"`
-	Name        string      `json:"name,omitempty"`
-	Files       []File      `json:"files,omitempty"`
-	Directories []Directory `json:"directories,omitempty"`
+	ID           string        `json:"-"`
+	Name         string        `json:"name,omitempty"`
+	Files        []File        `json:"files,omitempty"`
+	Directories  []Directory   `json:"directories,omitempty"`
+	Include      []string      `json:"include,omitempty"` // discovered files, all if empty
+	Exclude      []string      `json:"exclude,omitempty"` // discovered files and directories left out
+	Rules        []Rule        `json:"rules,omitempty"`
+	MergeModules []MergeModule `json:"-"`
+	InstallPath  string        `json:"-"` // relative to the install directory
+}
+
+// Rule sets the options of the discovered files matching a pattern,
+// the rules apply in order.
+type Rule struct {
+	Pattern        string   `json:"pattern"`
+	Service        *Service `json:"service,omitempty"`
+	NeverOverwrite bool     `json:"never_overwrite,omitempty"`
+	Permanent      bool     `json:"permanent,omitempty"`
+	Feature        string   `json:"feature,omitempty"`
 }
 
 type fileWalker func(file File) (File, error)
@@ -100,22 +135,48 @@ func walkFiles(files []File, dirs []Directory, f fileWalker) ([]File, []Director
 	return files, dirs, nil
 }
 
-type directoryWalker func(dir Directory) (Directory, error)
+type installedFileWalker func(dir string, file File) (File, error)
+
+// walkInstalledFiles walks the files along with the path of their directory
+// relative to the install directory.
+func (dir *Directory) walkInstalledFiles(f installedFileWalker) error {
+	return walkInstalledFiles("", dir, f)
+}
 
+func walkInstalledFiles(parent string, dir *Directory, f installedFileWalker) error {
+	for i, file := range dir.Files {
+		var err error
+		if dir.Files[i], err = f(parent, file); err != nil {
+			return err
+		}
+	}
+	for i := range dir.Directories {
+		sub := &dir.Directories[i]
+		if err := walkInstalledFiles(path.Join(parent, sub.Name), sub, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type directoryWalker func(parent string, dir Directory) (Directory, error)
+
+// walkDirectories walks the sub-directories along with the path of their
+// parent relative to the install directory.
 func (dir *Directory) walkDirectories(f directoryWalker) error {
 	var err error
-	dir.Directories, err = walkDirectories(dir.Directories, f)
+	dir.Directories, err = walkDirectories("", dir.Directories, f)
 	return err
 }
 
-func walkDirectories(dirs []Directory, f directoryWalker) ([]Directory, error) {
+func walkDirectories(parent string, dirs []Directory, f directoryWalker) ([]Directory, error) {
 	for i := range dirs {
 		var err error
-		dirs[i], err = f(dirs[i])
+		dirs[i], err = f(parent, dirs[i])
 		if err != nil {
 			return dirs, err
 		}
-		if err := dirs[i].walkDirectories(f); err != nil {
+		if dirs[i].Directories, err = walkDirectories(path.Join(parent, dirs[i].Name), dirs[i].Directories, f); err != nil {
 			return dirs, err
 		}
 	}
@@ -168,6 +229,8 @@ type Property struct {
 	ID       string    `json:"id"`
 	Registry *Registry `json:"registry,omitempty"`
 	Value    *Value    `json:"value,omitempty"`
+	Edited   bool      `json:"-"` // by a dialog input
+	Default  string    `json:"-"` // of the dialog input, when not found in the registry
 }
 
 // Registry describes a registry entry.
@@ -187,6 +250,505 @@ type Condition struct {
 	Message   string `json:"message"`
 }
 
+// Bundle describes a burn bootstrapper chaining prerequisites and packages
+// into a single setup executable.
+type Bundle struct {
+	Name        string         `json:"name,omitempty"`
+	UpgradeCode string         `json:"upgrade-code,omitempty"`
+	LicenseURL  string         `json:"license-url,omitempty"`
+	Logo        string         `json:"logo,omitempty"`
+	Searches    []BundleSearch `json:"searches,omitempty"`
+	Packages    []Package      `json:"packages,omitempty"`
+}
+
+// BundleSearch describes a registry search setting a burn variable,
+// usually referenced by the detect condition of a package.
+type BundleSearch struct {
+	Registry
+	Variable string `json:"variable"`
+	Result   string `json:"result,omitempty"` // value (default if omitted) or exists
+	Win64    bool   `json:"win64,omitempty"`
+}
+
+// Package describes a package chained into a bundle.
+type Package struct {
+	ID               string        `json:"id"`
+	Type             string        `json:"type"` // msi or exe
+	Path             string        `json:"path"`
+	DisplayName      string        `json:"display-name,omitempty"`
+	DetectCondition  string        `json:"detect-condition,omitempty"`
+	InstallCondition string        `json:"install-condition,omitempty"`
+	InstallCommand   string        `json:"install-command,omitempty"`
+	RepairCommand    string        `json:"repair-command,omitempty"`
+	UninstallCommand string        `json:"uninstall-command,omitempty"`
+	Vital            string        `json:"vital,omitempty"`
+	Permanent        string        `json:"permanent,omitempty"`
+	Properties       []MsiProperty `json:"properties,omitempty"`
+}
+
+// MsiProperty is a property passed to a chained msi package.
+type MsiProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Feature describes an installable feature, files and merge modules not bound
+// to a feature belong to the default feature.
+type Feature struct {
+	ID          string `json:"id"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Level       int    `json:"level,omitempty"`
+}
+
+// MergeModule describes a merge module (.msm) to include in the package.
+type MergeModule struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	Directory string `json:"directory,omitempty"` // relative to the install directory
+	Language  string `json:"language,omitempty"`
+	Feature   string `json:"feature,omitempty"`
+}
+
+// Upgrade describes how the package upgrades the installed products.
+type Upgrade struct {
+	AllowDowngrades  bool            `json:"allow-downgrades,omitempty"`
+	AllowSameVersion bool            `json:"allow-same-version,omitempty"`
+	Schedule         string          `json:"schedule,omitempty"` // afterInstallValidate (default if omitted), afterInstallInitialize, afterInstallExecute, afterInstallExecuteAgain or afterInstallFinalize
+	DowngradeMessage string          `json:"downgrade-message,omitempty"`
+	Legacy           []LegacyUpgrade `json:"legacy,omitempty"`
+}
+
+// LegacyUpgrade describes older products installed with another upgrade code
+// and removed by the package.
+type LegacyUpgrade struct {
+	UpgradeCode string `json:"upgrade-code"`
+	Minimum     string `json:"minimum,omitempty"` // included, 0.0.0 if omitted
+	Maximum     string `json:"maximum,omitempty"` // excluded, no maximum if omitted
+	Property    string `json:"-"`
+}
+
+func (wixFile *WixManifest) checkUpgrade() error {
+	u := wixFile.Upgrade
+	if u == nil {
+		return nil
+	}
+	if wixFile.Kind == "module" {
+		return fmt.Errorf("upgrade is not supported in merge modules")
+	}
+	switch u.Schedule {
+	case "", "afterInstallValidate", "afterInstallInitialize", "afterInstallExecute", "afterInstallExecuteAgain", "afterInstallFinalize":
+	default:
+		return fmt.Errorf(`Invalid "schedule" value in upgrade: %s`, u.Schedule)
+	}
+	if u.AllowDowngrades && u.DowngradeMessage != "" {
+		return fmt.Errorf(`"downgrade-message" can not be set in upgrade when "allow-downgrades" is`)
+	}
+	for _, l := range u.Legacy {
+		if _, err := uuid.Parse(l.UpgradeCode); err != nil {
+			return fmt.Errorf(`Invalid "upgrade-code" value in legacy upgrade: %s`, l.UpgradeCode)
+		}
+		if strings.EqualFold(strings.Trim(l.UpgradeCode, "{}"), strings.Trim(wixFile.UpgradeCode, "{}")) {
+			return fmt.Errorf(`Invalid "upgrade-code" value in legacy upgrade, it is the product upgrade code: %s`, l.UpgradeCode)
+		}
+		for _, v := range []string{l.Minimum, l.Maximum} {
+			if v != "" && !msiVersion.MatchString(v) {
+				return fmt.Errorf(`Invalid version in legacy upgrade %s, it must be like x.x.x.x: %s`, l.UpgradeCode, v)
+			}
+		}
+	}
+	return nil
+}
+
+var msiVersion = regexp.MustCompile(`^\d+(\.\d+){0,3}$`)
+
+// UI describes the installer user interface.
+type UI struct {
+	Mode   string  `json:"mode,omitempty"` // none, minimal, install-dir (default if omitted), feature-tree or advanced
+	Launch *Launch `json:"launch,omitempty"`
+}
+
+// Launch describes the application the exit dialog offers to launch.
+type Launch struct {
+	File    string `json:"file"` // path of an installed file, as listed in the manifest
+	Text    string `json:"text,omitempty"`
+	Checked bool   `json:"checked,omitempty"`
+	FileID  string `json:"-"`
+}
+
+// UIMode returns the mode of the installer user interface.
+func (wixFile *WixManifest) UIMode() string {
+	if wixFile.UI == nil || wixFile.UI.Mode == "" {
+		return "install-dir"
+	}
+	return wixFile.UI.Mode
+}
+
+func (wixFile *WixManifest) checkUI() error {
+	switch wixFile.UIMode() {
+	case "none":
+		if len(wixFile.Dialogs) > 0 {
+			return fmt.Errorf("dialogs are not supported without user interface")
+		}
+		if wixFile.UI.Launch != nil {
+			return fmt.Errorf("launch is not supported without user interface")
+		}
+	case "minimal", "install-dir", "feature-tree", "advanced":
+	default:
+		return fmt.Errorf(`Invalid "mode" value in ui: %s`, wixFile.UI.Mode)
+	}
+	return nil
+}
+
+// Dialog describes a custom dialog page of the installer UI,
+// it is shown after the license dialog.
+type Dialog struct {
+	ID          string  `json:"id,omitempty"`
+	Title       string  `json:"title"`
+	Description string  `json:"description,omitempty"`
+	Inputs      []Input `json:"inputs"`
+}
+
+// Input describes a dialog input control bound to a property.
+type Input struct {
+	Label      string      `json:"label"`
+	Property   string      `json:"property"`
+	Type       string      `json:"type,omitempty"` // text (default if omitted), password, checkbox or dropdown
+	Default    string      `json:"default,omitempty"`
+	Options    []Option    `json:"options,omitempty"`
+	Validation *Validation `json:"validation,omitempty"`
+	Y          int         `json:"-"`
+	Searched   bool        `json:"-"` // declared by a property of the manifest searching the registry
+}
+
+// Option is a value of a dropdown input.
+type Option struct {
+	Value string `json:"value"`
+	Text  string `json:"text,omitempty"`
+}
+
+// Validation describes the rules an input value must follow
+// to move to the next dialog.
+type Validation struct {
+	Required  bool   `json:"required,omitempty"`
+	MaxLength int    `json:"max-length,omitempty"`
+	Condition string `json:"condition,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// ControlY returns the vertical position of the input control,
+// below its label.
+func (input Input) ControlY() int {
+	if input.Type == "checkbox" {
+		return input.Y
+	}
+	return input.Y + 14
+}
+
+// Check is a condition to validate before leaving a dialog
+// and the message to show when it is not met.
+type Check struct {
+	Condition string
+	Message   string
+	Failed    string // met when this check is the first one to fail
+	Order     int
+}
+
+// Checks returns the conditions to validate before leaving the dialog.
+func (dialog Dialog) Checks() []Check {
+	var checks []Check
+	for _, input := range dialog.Inputs {
+		v := input.Validation
+		if v == nil {
+			continue
+		}
+		label := strings.TrimSuffix(input.Label, ":")
+		if v.Required && input.Type != "checkbox" {
+			checks = append(checks, Check{
+				Condition: input.Property,
+				Message:   fmt.Sprintf("%s is required.", label),
+			})
+		}
+		if v.Condition != "" {
+			message := v.Message
+			if message == "" {
+				message = fmt.Sprintf("%s is invalid.", label)
+			}
+			checks = append(checks, Check{Condition: v.Condition, Message: message})
+		}
+	}
+	for i := range checks {
+		failed := []string{"NOT (" + checks[i].Condition + ")"}
+		for _, c := range checks[:i] {
+			failed = append(failed, "("+c.Condition+")")
+		}
+		checks[i].Failed = strings.Join(failed, " AND ")
+		checks[i].Order = 2*i + 1
+	}
+	return checks
+}
+
+// Valid returns the condition met when all the checks of the dialog pass.
+func (dialog Dialog) Valid() string {
+	var valid []string
+	for _, c := range dialog.Checks() {
+		valid = append(valid, "("+c.Condition+")")
+	}
+	if len(valid) == 0 {
+		return "1"
+	}
+	return strings.Join(valid, " AND ")
+}
+
+const (
+	dialogTop    = 52
+	dialogBottom = 228
+)
+
+func (wixFile *WixManifest) normalizeDialogs() error {
+	ids := make(map[string]bool)
+	properties := make(map[string]bool)
+	searched := make(map[string]*Property)
+	for i, prop := range wixFile.Properties {
+		if prop.Registry != nil && prop.Value == nil {
+			searched[prop.ID] = &wixFile.Properties[i]
+		} else {
+			properties[prop.ID] = true
+		}
+	}
+	for i := range wixFile.Dialogs {
+		dialog := &wixFile.Dialogs[i]
+		if dialog.ID == "" {
+			dialog.ID = fmt.Sprintf("CustomDlg%d", i)
+		}
+		if ids[dialog.ID] {
+			return fmt.Errorf(`Duplicate "id" value in dialog: %s`, dialog.ID)
+		}
+		ids[dialog.ID] = true
+		if len(dialog.Inputs) == 0 {
+			return fmt.Errorf(`Missing "inputs" value in dialog: %s`, dialog.ID)
+		}
+		y := dialogTop
+		for j := range dialog.Inputs {
+			input := &dialog.Inputs[j]
+			if input.Property == "" || input.Property != strings.ToUpper(input.Property) {
+				return fmt.Errorf(`Invalid "property" value in dialog %s, it must be a public (uppercase) property: %q`, dialog.ID, input.Property)
+			}
+			if properties[input.Property] {
+				return fmt.Errorf(`Duplicate "property" value in dialog %s: %s`, dialog.ID, input.Property)
+			}
+			properties[input.Property] = true
+			// the value found in the registry is the default of the input
+			prop := searched[input.Property]
+			if prop != nil {
+				input.Searched = true
+				prop.Edited = true
+			}
+			if input.Type == "" {
+				input.Type = "text"
+			}
+			input.Y = y
+			switch input.Type {
+			case "text", "password":
+				y += 36
+			case "dropdown":
+				if len(input.Options) == 0 {
+					return fmt.Errorf(`Missing "options" value in dropdown input: %s`, input.Property)
+				}
+				for k := range input.Options {
+					if input.Options[k].Text == "" {
+						input.Options[k].Text = input.Options[k].Value
+					}
+				}
+				if input.Default == "" {
+					input.Default = input.Options[0].Value
+				}
+				y += 36
+			case "checkbox":
+				if input.Default != "" && input.Default != "1" {
+					return fmt.Errorf(`Invalid "default" value in checkbox input %s, it must be empty or 1`, input.Property)
+				}
+				y += 24
+			default:
+				return fmt.Errorf(`Invalid "type" value in input %s: %s`, input.Property, input.Type)
+			}
+			if prop != nil {
+				prop.Default = input.Default
+			}
+		}
+		if y > dialogBottom {
+			return fmt.Errorf("Too many inputs in dialog %s, split them into several dialogs", dialog.ID)
+		}
+	}
+	return nil
+}
+
+// UISequence returns the identifiers of the dialogs shown during an install,
+// in order.
+func (wixFile *WixManifest) UISequence() []string {
+	mode := wixFile.UIMode()
+	if mode == "none" {
+		return nil
+	}
+	seq := []string{"WelcomeDlg"}
+	if wixFile.License != "" {
+		seq = append(seq, "LicenseAgreementDlg_HK")
+	}
+	for _, dialog := range wixFile.Dialogs {
+		seq = append(seq, dialog.ID)
+	}
+	if mode == "install-dir" || mode == "advanced" {
+		seq = append(seq, "InstallDirDlg")
+	}
+	if mode == "feature-tree" || mode == "advanced" {
+		seq = append(seq, "CustomizeDlg")
+	}
+	return append(seq, "VerifyReadyDlg")
+}
+
+// UIHas tells if the given dialog is part of the install sequence.
+func (wixFile *WixManifest) UIHas(id string) bool {
+	for _, d := range wixFile.UISequence() {
+		if d == id {
+			return true
+		}
+	}
+	return false
+}
+
+// UINext returns the identifier of the dialog shown after the given one.
+func (wixFile *WixManifest) UINext(id string) string {
+	seq := wixFile.UISequence()
+	for i := 0; i+1 < len(seq); i++ {
+		if seq[i] == id {
+			return seq[i+1]
+		}
+	}
+	return ""
+}
+
+// UIPrevious returns the identifier of the dialog shown before the given one.
+func (wixFile *WixManifest) UIPrevious(id string) string {
+	seq := wixFile.UISequence()
+	for i := 1; i < len(seq); i++ {
+		if seq[i] == id {
+			return seq[i-1]
+		}
+	}
+	return ""
+}
+
+// Language describes a culture the package is localized for.
+// Strings override the localized product strings by id (ProductName,
+// ProductDescription, ProductComments, DowngradeErrorMessage) and may define
+// additional strings, conditions messages are matched by index.
+type Language struct {
+	Culture    string            `json:"culture"`
+	LCID       int               `json:"lcid,omitempty"`
+	Codepage   int               `json:"codepage,omitempty"`
+	License    string            `json:"license,omitempty"`
+	Strings    map[string]string `json:"strings,omitempty"`
+	Conditions []string          `json:"conditions,omitempty"`
+}
+
+var lcids = map[string]int{
+	"ar-sa": 1025, "bg-bg": 1026, "ca-es": 1027, "cs-cz": 1029, "da-dk": 1030,
+	"de-de": 1031, "el-gr": 1032, "en-us": 1033, "es-es": 3082, "et-ee": 1061,
+	"fi-fi": 1035, "fr-fr": 1036, "he-il": 1037, "hi-in": 1081, "hr-hr": 1050,
+	"hu-hu": 1038, "it-it": 1040, "ja-jp": 1041, "kk-kz": 1087, "ko-kr": 1042,
+	"lt-lt": 1063, "lv-lv": 1062, "nb-no": 1044, "nl-nl": 1043, "pl-pl": 1045,
+	"pt-br": 1046, "pt-pt": 2070, "ro-ro": 1048, "ru-ru": 1049, "sk-sk": 1051,
+	"sl-si": 1060, "sq-al": 1052, "sr-latn-rs": 9242, "sv-se": 1053, "th-th": 1054,
+	"tr-tr": 1055, "uk-ua": 1058, "zh-cn": 2052, "zh-hk": 3076, "zh-tw": 1028,
+}
+
+var codepages = map[int]int{
+	1025: 1256, 1026: 1251, 1029: 1250, 1032: 1253, 1037: 1255, 1038: 1250,
+	1041: 932, 1042: 949, 1045: 1250, 1048: 1250, 1049: 1251, 1050: 1250,
+	1051: 1250, 1052: 1250, 1054: 874, 1055: 1254, 1058: 1251, 1060: 1250,
+	1061: 1257, 1062: 1257, 1063: 1257, 1081: 65001, 1087: 1251, 2052: 936,
+	3076: 950, 1028: 950, 9242: 1250,
+}
+
+// Loc returns a reference to the localized string id when the manifest
+// is localized, otherwise it returns the given default value.
+func (wixFile *WixManifest) Loc(id, value string) string {
+	if len(wixFile.Languages) == 0 {
+		return value
+	}
+	return "!(loc." + id + ")"
+}
+
+// DowngradeMessage returns the message shown when a newer version
+// is already installed.
+func (wixFile *WixManifest) DowngradeMessage() string {
+	if wixFile.Upgrade != nil && wixFile.Upgrade.DowngradeMessage != "" {
+		return wixFile.Upgrade.DowngradeMessage
+	}
+	return "A newer version of this software is already installed."
+}
+
+// LocStrings returns the localized strings of the given language,
+// manifest values are used for the strings the language does not define.
+func (wixFile *WixManifest) LocStrings(lang Language) map[string]string {
+	strs := map[string]string{
+		"ProductName":           wixFile.Product,
+		"ProductDescription":    wixFile.Product + " " + wixFile.Version.Display,
+		"ProductComments":       "This installs " + wixFile.Product + " " + wixFile.Version.Display,
+		"DowngradeErrorMessage": wixFile.DowngradeMessage(),
+		"ProductLanguage":       strconv.Itoa(lang.LCID),
+		"ProductCodepage":       strconv.Itoa(lang.Codepage),
+	}
+	for i, c := range wixFile.Conditions {
+		id := fmt.Sprintf("Condition%d", i)
+		strs[id] = c.Message
+		if i < len(lang.Conditions) && lang.Conditions[i] != "" {
+			strs[id] = lang.Conditions[i]
+		}
+	}
+	for k, v := range lang.Strings {
+		strs[k] = v
+	}
+	return strs
+}
+
+func (wixFile *WixManifest) normalizeLanguages() error {
+	cultures := make(map[string]bool)
+	for i := range wixFile.Languages {
+		lang := &wixFile.Languages[i]
+		lang.Culture = strings.ToLower(lang.Culture)
+		if lang.Culture == "" {
+			return fmt.Errorf(`Missing "culture" value in language`)
+		}
+		if cultures[lang.Culture] {
+			return fmt.Errorf(`Duplicate "culture" value in language: %s`, lang.Culture)
+		}
+		cultures[lang.Culture] = true
+		if lang.LCID == 0 {
+			lcid, ok := lcids[lang.Culture]
+			if !ok {
+				return fmt.Errorf(`Unknown culture %q in language, set its "lcid" value`, lang.Culture)
+			}
+			lang.LCID = lcid
+		}
+		if lang.Codepage == 0 {
+			lang.Codepage = 1252
+			if cp, ok := codepages[lang.LCID]; ok {
+				lang.Codepage = cp
+			}
+		}
+		if lang.License == "" {
+			lang.License = wixFile.License
+		} else if wixFile.License == "" {
+			return fmt.Errorf(`The "license" value of language %s requires a default license`, lang.Culture)
+		}
+		if len(lang.Conditions) > len(wixFile.Conditions) {
+			return fmt.Errorf(`Too many "conditions" values in language %s`, lang.Culture)
+		}
+	}
+	return nil
+}
+
 // Environment is the struct to decode environment variables of the wix.json file.
 type Environment struct {
 	Name      string `json:"name"`
@@ -231,13 +793,25 @@ type RegistryValue struct {
 	Value string `json:"value"`
 }
 
+// Marshal returns the canonical wix.json encoding of the manifest,
+// indented by two spaces in the field order of the structs.
+func (wixFile *WixManifest) Marshal() ([]byte, error) {
+	byt, err := json.MarshalIndent(wixFile, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(byt, '\n'), nil
+}
+
 // Write the manifest to the given file,
-// if file is empty, writes to wix.json
+// if file is empty, writes to wix.json.
+// The paths are written relative to the file, except for the absolute
+// paths out of its directory.
 func (wixFile *WixManifest) Write(p string) error {
 	if p == "" {
 		p = "wix.json"
 	}
-	byt, err := json.MarshalIndent(wixFile, "", "  ")
+	byt, err := wixFile.MarshalRelative(filepath.Dir(p))
 	if err != nil {
 		return err
 	}
@@ -248,9 +822,114 @@ func (wixFile *WixManifest) Write(p string) error {
 	return nil
 }
 
+// MarshalRelative marshals the manifest with the paths relative to dir,
+// except for the absolute paths out of it.
+func (wixFile *WixManifest) MarshalRelative(dir string) ([]byte, error) {
+	c, err := wixFile.clone()
+	if err != nil {
+		return nil, err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.walkPaths(func(p string) string {
+		abs, err := filepath.Abs(filepath.FromSlash(p))
+		if err != nil {
+			return p
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil {
+			return p
+		}
+		// the absolute paths out of the directory stay absolute
+		if filepath.IsAbs(filepath.FromSlash(p)) && (rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return p
+		}
+		return filepath.ToSlash(rel)
+	})
+	return c.Marshal()
+}
+
+// WriteDebug writes the manifest along with its discovered files to
+// wix.dynamic.json next to the manifest file p, to inspect it manually
+// while debugging builds.
+func (wixFile *WixManifest) WriteDebug(p string) error {
+	if p == "" {
+		p = "wix.json"
+	}
+	b, err := json.MarshalIndent(wixFile, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(filepath.Dir(p), "wix.dynamic.json"), b, 0644)
+}
+
+// walkPaths replaces the paths to files of the manifest, the empty ones
+// excepted, by the result of f.
+func (wixFile *WixManifest) walkPaths(f func(p string) string) {
+	replace := func(p *string) {
+		if *p != "" {
+			*p = f(*p)
+		}
+	}
+	replace(&wixFile.License)
+	replace(&wixFile.Banner)
+	replace(&wixFile.Dialog)
+	replace(&wixFile.Icon)
+	for i := range wixFile.Languages {
+		replace(&wixFile.Languages[i].License)
+	}
+	for i := range wixFile.Shortcuts {
+		replace(&wixFile.Shortcuts[i].Icon)
+	}
+	for i := range wixFile.MergeModules {
+		replace(&wixFile.MergeModules[i].Path)
+	}
+	if wixFile.Bundle != nil {
+		replace(&wixFile.Bundle.Logo)
+		for i := range wixFile.Bundle.Packages {
+			replace(&wixFile.Bundle.Packages[i].Path)
+		}
+	}
+	if wixFile.UI != nil && wixFile.UI.Launch != nil {
+		replace(&wixFile.UI.Launch.File)
+	}
+	wixFile.walkFiles(func(file File) (File, error) {
+		replace(&file.Path)
+		return file, nil
+	})
+}
+
+// resolvePaths joins the relative paths of the manifest to BaseDir.
+func (wixFile *WixManifest) resolvePaths() {
+	if wixFile.BaseDir == "" || wixFile.BaseDir == "." {
+		return
+	}
+	wixFile.walkPaths(func(p string) string {
+		if filepath.IsAbs(filepath.FromSlash(p)) {
+			return p
+		}
+		return filepath.ToSlash(filepath.Join(wixFile.BaseDir, filepath.FromSlash(p)))
+	})
+}
+
 // Load the manifest from given file path,
-// if the file path is empty, reads from wix.json
+// if the file path is empty, reads from wix.json.
+// The relative paths are resolved against BaseDir, set to the directory
+// of the file if empty.
 func (wixFile *WixManifest) Load(p string) error {
+	if err := wixFile.Read(p); err != nil {
+		return err
+	}
+
+	// dynamically build wixFile.Directories
+	return wixFile.buildDirectoriesRecursive()
+}
+
+// Read the manifest like Load without discovering the content of its
+// directories, for the commands editing and writing back the manifest.
+func (wixFile *WixManifest) Read(p string) error {
 	if p == "" {
 		p = "wix.json"
 	}
@@ -269,8 +948,12 @@ func (wixFile *WixManifest) Load(p string) error {
 		return fmt.Errorf("JSON Unmarshal failed with %v", err)
 	}
 
-	// dynamically build wixFile.Directories
-	return wixFile.buildDirectoriesRecursive()
+	// the paths are relative to the manifest file unless set otherwise
+	if wixFile.BaseDir == "" {
+		wixFile.BaseDir = filepath.Dir(p)
+	}
+	wixFile.resolvePaths()
+	return nil
 }
 
 // buildDirectoriesRecursive detects all files and directories nested under a top level
@@ -285,74 +968,126 @@ func (wixFile *WixManifest) Load(p string) error {
 //		    }
 //		],
 func (wixFile *WixManifest) buildDirectoriesRecursive() error {
-	for key, _ := range wixFile.Directories {
-		err := buildDirectories(".", &wixFile.Directories[key])
+	base := filepath.ToSlash(wixFile.BaseDir)
+	if base == "" {
+		base = "."
+	}
+	for key := range wixFile.Directories {
+		err := buildDirectories(base, &wixFile.Directories[key])
 		if err != nil {
 			return err
 		}
 	}
-
-	// Write the dynamic config to disk so we can inspect it manually
-	// while debugging builds.
-	b, err := json.MarshalIndent(wixFile, "", " ")
-	if err != nil {
-		return fmt.Errorf("DEBUG: failed to marshal fix config: %v", err)
-	}
-	f, err := os.Create("wix.dynamic.json")
-	if err != nil {
-		return err
-	}
-	if _, err := f.Write(b); err != nil {
-		return fmt.Errorf("failed to write dynamic wix config to disk: %v", err)
-	}
-	return f.Close()
+	return nil
 }
 
 // buildDirectories detects all sub files and directories for the given
 // *Directory. Useful for performing auto detection when there are too
 // many files and directories to specify in the wix.json.
 func buildDirectories(parentPath string, dir *Directory) error {
-	// Get a list of all files and directories
-	p := path.Join(parentPath, dir.Name)
+	for _, p := range dir.Include {
+		if !validPattern(p) {
+			return fmt.Errorf(`Invalid "include" value in directory %s: %s`, dir.Name, p)
+		}
+	}
+	for _, p := range dir.Exclude {
+		if !validPattern(p) {
+			return fmt.Errorf(`Invalid "exclude" value in directory %s: %s`, dir.Name, p)
+		}
+	}
+	for _, r := range dir.Rules {
+		if !validPattern(r.Pattern) {
+			return fmt.Errorf(`Invalid "pattern" value in rule of directory %s: %s`, dir.Name, r.Pattern)
+		}
+	}
+	return dir.discover(path.Join(parentPath, dir.Name), "", dir)
+}
+
+// discover appends the files and directories found in p to dir, rel is
+// the path of p relative to the top directory.
+func (top *Directory) discover(p, rel string, dir *Directory) error {
 	list, err := ioutil.ReadDir(p)
 	if err != nil {
 		return fmt.Errorf("failed to read path: %s", p)
 	}
 
-	// Iterate over the list:
-	// Append all files to the directories []Files list
-	// When a directory is detected, call this function again
-	// and grap it's sub directories and files before appending
-	// to the parent directory.
+	// Append all the files to the directory, when a directory is
+	// detected grab its sub directories and files before appending it.
 	for _, sub := range list {
-		// purposely shadowing
-		parentPath := path.Join(parentPath, dir.Name)
+		subRel := path.Join(rel, sub.Name())
+		if matchAny(top.Exclude, subRel) {
+			continue
+		}
 
 		if !sub.IsDir() {
-			subFile := File{
-				Path: path.Join(parentPath, sub.Name()),
+			if len(top.Include) > 0 && !matchAny(top.Include, subRel) {
+				continue
 			}
-			dir.Files = append(dir.Files, subFile)
+			file := File{
+				Path: path.Join(p, sub.Name()),
+			}
+			top.applyRules(subRel, &file)
+			dir.Files = append(dir.Files, file)
 			continue
 		}
 
 		subDir := Directory{
 			Name: sub.Name(),
 		}
-
-		err := buildDirectories(parentPath, &subDir)
-		if err != nil {
+		if err := top.discover(path.Join(p, sub.Name()), subRel, &subDir); err != nil {
 			return err
 		}
-
-		// When finished building the directory tree, append the directory
-		// to the parent directory.
+		// Leave out the directories without any included file.
+		if len(top.Include) > 0 && len(subDir.Files) == 0 && len(subDir.Directories) == 0 {
+			continue
+		}
 		dir.Directories = append(dir.Directories, subDir)
 	}
 
 	return nil
 }
 
+func (top *Directory) applyRules(rel string, file *File) {
+	for _, r := range top.Rules {
+		if !matchAny([]string{r.Pattern}, rel) {
+			continue
+		}
+		if r.Service != nil {
+			service := *r.Service
+			file.Service = &service
+		}
+		file.NeverOverwrite = file.NeverOverwrite || r.NeverOverwrite
+		file.Permanent = file.Permanent || r.Permanent
+		if r.Feature != "" {
+			file.Feature = r.Feature
+		}
+	}
+}
+
+// validPattern checks the syntax of a doublestar pattern.
+func validPattern(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny tells whether the slash separated path matches one of the
+// doublestar patterns.
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := doublestar.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (wixFile *WixManifest) check() error {
 	for _, hook := range wixFile.Hooks {
 		switch hook.When {
@@ -373,12 +1108,218 @@ func (wixFile *WixManifest) check() error {
 			return fmt.Errorf(`Invalid "location" value in shortcut: %s`, shortcut.Location)
 		}
 	}
+	if err := wixFile.checkBundle(); err != nil {
+		return err
+	}
+	if err := wixFile.checkFeatures(); err != nil {
+		return err
+	}
+	if err := wixFile.checkKind(); err != nil {
+		return err
+	}
+	if err := wixFile.checkUI(); err != nil {
+		return err
+	}
+	if err := wixFile.checkUpgrade(); err != nil {
+		return err
+	}
 	if wixFile.NeedGUID() {
 		return fmt.Errorf(`The manifest needs Guid, To update your file automatically run "go-msi set-guid"`)
 	}
 	return nil
 }
 
+// MainPackageID is the id of the msi package chained by ChainMsi.
+const MainPackageID = "MainPackage"
+
+// ChainMsi chains the msi package after the packages of the bundle, the
+// id of the manifest packages must not collide with its MainPackageID.
+func (bundle *Bundle) ChainMsi(msi string) error {
+	for _, pkg := range bundle.Packages {
+		if pkg.ID == MainPackageID {
+			return fmt.Errorf(`Invalid "id" value in bundle package, reserved for the --msi package: %s`, pkg.ID)
+		}
+	}
+	bundle.Packages = append(bundle.Packages, Package{
+		ID:   MainPackageID,
+		Type: "msi",
+		Path: msi,
+	})
+	return nil
+}
+
+func (wixFile *WixManifest) checkBundle() error {
+	if wixFile.Bundle == nil {
+		return nil
+	}
+	ids := make(map[string]bool)
+	for _, pkg := range wixFile.Bundle.Packages {
+		if pkg.ID == "" {
+			return fmt.Errorf(`Missing "id" value in bundle package: %s`, pkg.Path)
+		}
+		if ids[pkg.ID] {
+			return fmt.Errorf(`Duplicate "id" value in bundle package: %s`, pkg.ID)
+		}
+		ids[pkg.ID] = true
+		switch pkg.Type {
+		case "msi":
+			if pkg.InstallCommand != "" || pkg.RepairCommand != "" || pkg.UninstallCommand != "" {
+				return fmt.Errorf(`Invalid command in msi bundle package: %s`, pkg.ID)
+			}
+		case "exe":
+			if pkg.DetectCondition == "" {
+				return fmt.Errorf(`Missing "detect-condition" value in exe bundle package: %s`, pkg.ID)
+			}
+		default:
+			return fmt.Errorf(`Invalid "type" value in bundle package: %s`, pkg.Type)
+		}
+		for _, v := range []string{pkg.Vital, pkg.Permanent} {
+			switch v {
+			case "yes", "no", "":
+			default:
+				return fmt.Errorf(`Invalid yes/no value in bundle package: %s`, v)
+			}
+		}
+	}
+	for _, search := range wixFile.Bundle.Searches {
+		switch search.Result {
+		case "value", "exists", "":
+		default:
+			return fmt.Errorf(`Invalid "result" value in bundle search: %s`, search.Result)
+		}
+	}
+	return nil
+}
+
+func (wixFile *WixManifest) checkFeatures() error {
+	features := map[string]bool{"": true, "DefaultFeature": true}
+	for _, feature := range wixFile.Features {
+		if feature.ID == "" {
+			return fmt.Errorf(`Missing "id" value in feature: %s`, feature.Title)
+		}
+		if features[feature.ID] {
+			return fmt.Errorf(`Duplicate "id" value in feature: %s`, feature.ID)
+		}
+		features[feature.ID] = true
+	}
+	if err := wixFile.walkFiles(func(file File) (File, error) {
+		if !features[file.Feature] {
+			return file, fmt.Errorf(`Invalid "feature" value in file %s: %s`, file.Path, file.Feature)
+		}
+		return file, nil
+	}); err != nil {
+		return err
+	}
+	modules := make(map[string]bool)
+	for _, module := range wixFile.MergeModules {
+		if module.ID == "" {
+			return fmt.Errorf(`Missing "id" value in merge module: %s`, module.Path)
+		}
+		if modules[module.ID] {
+			return fmt.Errorf(`Duplicate "id" value in merge module: %s`, module.ID)
+		}
+		modules[module.ID] = true
+		if !features[module.Feature] {
+			return fmt.Errorf(`Invalid "feature" value in merge module %s: %s`, module.ID, module.Feature)
+		}
+	}
+	return nil
+}
+
+func (wixFile *WixManifest) checkKind() error {
+	switch wixFile.Kind {
+	case "", "product":
+		return nil
+	case "module":
+	default:
+		return fmt.Errorf("invalid kind %q, must be one of product, module", wixFile.Kind)
+	}
+	if len(wixFile.Hooks) > 0 {
+		return fmt.Errorf("hooks are not supported in merge modules")
+	}
+	if len(wixFile.Conditions) > 0 {
+		return fmt.Errorf("conditions are not supported in merge modules")
+	}
+	if len(wixFile.Features) > 0 {
+		return fmt.Errorf("features are not supported in merge modules")
+	}
+	if len(wixFile.MergeModules) > 0 {
+		return fmt.Errorf("merge modules can not include other merge modules")
+	}
+	if wixFile.ModuleCode != "" {
+		if _, err := uuid.Parse(wixFile.ModuleCode); err != nil {
+			return fmt.Errorf(`Invalid "module-code" value: %s`, wixFile.ModuleCode)
+		}
+	} else if wixFile.ModuleGUID() == "*" {
+		return fmt.Errorf(`Invalid "upgrade-code" value to derive the merge module guid: %s`, wixFile.UpgradeCode)
+	}
+	return nil
+}
+
+// FeatureFiles returns the files bound to the given feature,
+// an empty id stands for the default feature.
+func (wixFile *WixManifest) FeatureFiles(id string) []File {
+	if id == "DefaultFeature" {
+		id = ""
+	}
+	var files []File
+	wixFile.walkFiles(func(file File) (File, error) {
+		if file.Feature == id {
+			files = append(files, file)
+		}
+		return file, nil
+	})
+	return files
+}
+
+// AllFiles returns the files of the manifest in the order of the directories.
+func (wixFile *WixManifest) AllFiles() []File {
+	var files []File
+	wixFile.walkFiles(func(file File) (File, error) {
+		files = append(files, file)
+		return file, nil
+	})
+	return files
+}
+
+// FeatureMergeModules returns the merge modules bound to the given feature,
+// an empty id stands for the default feature.
+func (wixFile *WixManifest) FeatureMergeModules(id string) []MergeModule {
+	if id == "DefaultFeature" {
+		id = ""
+	}
+	var modules []MergeModule
+	for _, module := range wixFile.MergeModules {
+		if module.Feature == id {
+			modules = append(modules, module)
+		}
+	}
+	return modules
+}
+
+// ModuleGUID returns the package guid of the merge module, the module
+// code or a guid derived from the upgrade code, distinct from it.
+func (wixFile *WixManifest) ModuleGUID() string {
+	if wixFile.ModuleCode != "" {
+		return wixFile.ModuleCode
+	}
+	return wixFile.ComponentGUID("merge module")
+}
+
+// ModuleID returns the product name turned into a valid merge module identifier.
+func (wixFile *WixManifest) ModuleID() string {
+	id := []rune(wixFile.Product)
+	for i, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.') {
+			id[i] = '_'
+		}
+	}
+	if len(id) == 0 || id[0] >= '0' && id[0] <= '9' || id[0] == '.' {
+		return "_" + string(id)
+	}
+	return string(id)
+}
+
 // SetGuids generates and apply guid values appropriately
 func (wixFile *WixManifest) SetGuids(force bool) (bool, error) {
 	updated := false
@@ -390,6 +1331,14 @@ func (wixFile *WixManifest) SetGuids(force bool) (bool, error) {
 		wixFile.UpgradeCode = guid
 		updated = true
 	}
+	if wixFile.Bundle != nil && (wixFile.Bundle.UpgradeCode == "" || force) {
+		guid, err := makeGUID()
+		if err != nil {
+			return updated, err
+		}
+		wixFile.Bundle.UpgradeCode = guid
+		updated = true
+	}
 	return updated, nil
 }
 
@@ -403,7 +1352,60 @@ func makeGUID() (string, error) {
 
 // NeedGUID tells if the manifest json file is missing guid values.
 func (wixFile *WixManifest) NeedGUID() bool {
-	return wixFile.UpgradeCode == ""
+	return wixFile.UpgradeCode == "" || (wixFile.Bundle != nil && wixFile.Bundle.UpgradeCode == "")
+}
+
+// AssignIDs computes the path of directories and files relative to the
+// install directory and derives their missing identifiers from it, so that
+// they stay the same across builds.
+func (wixFile *WixManifest) AssignIDs() error {
+	dirs := make(map[string]string)
+	if err := wixFile.walkDirectories(func(parent string, dir Directory) (Directory, error) {
+		dir.InstallPath = path.Join(parent, dir.Name)
+		if dir.ID == "" {
+			dir.ID = stableID(dir.InstallPath)
+		}
+		if other, ok := dirs[dir.ID]; ok {
+			return dir, fmt.Errorf("directories %s and %s have the same identifier %s", other, dir.InstallPath, dir.ID)
+		}
+		dirs[dir.ID] = dir.InstallPath
+		return dir, nil
+	}); err != nil {
+		return err
+	}
+	namespace, _ := uuid.Parse(wixFile.UpgradeCode)
+	files := make(map[string]string)
+	return wixFile.walkInstalledFiles(func(dir string, file File) (File, error) {
+		file.InstallPath = path.Join(dir, filepath.Base(filepath.FromSlash(file.Path)))
+		if file.ID == "" {
+			file.ID = stableID(file.InstallPath)
+		}
+		if file.GUID == "" && namespace != uuid.Nil {
+			file.GUID = "{" + strings.ToUpper(uuid.NewSHA1(namespace, []byte(strings.ToLower(file.InstallPath))).String()) + "}"
+		}
+		if other, ok := files[file.ID]; ok {
+			return file, fmt.Errorf("files %s and %s have the same identifier %s", other, file.InstallPath, file.ID)
+		}
+		files[file.ID] = file.InstallPath
+		return file, nil
+	})
+}
+
+// ComponentGUID derives the guid of a component from its identifier,
+// for the toolsets that do not generate them.
+func (wixFile *WixManifest) ComponentGUID(id string) string {
+	namespace, err := uuid.Parse(wixFile.UpgradeCode)
+	if err != nil {
+		return "*"
+	}
+	return "{" + strings.ToUpper(uuid.NewSHA1(namespace, []byte(id)).String()) + "}"
+}
+
+// stableID derives an identifier from a path relative to the install
+// directory, windows paths being case insensitive.
+func stableID(installPath string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(installPath)))
+	return strings.ToUpper(hex.EncodeToString(sum[:8]))
 }
 
 // RewriteFilePaths reads files and directories of the wix.json file
@@ -423,27 +1425,30 @@ func (wixFile *WixManifest) RewriteFilePaths(out string) error {
 		wixFile.License = path
 	}
 
-	id := 1
-	if err := wixFile.walkDirectories(func(dir Directory) (Directory, error) {
-		dir.ID = id
-		id++
-		return dir, nil
-	}); err != nil {
+	if err := wixFile.AssignIDs(); err != nil {
 		return err
 	}
-	id = 1
+	var launch *Launch
+	if wixFile.UI != nil && wixFile.UI.Launch != nil {
+		launch = wixFile.UI.Launch
+		launch.FileID = ""
+	}
 	if err := wixFile.walkFiles(func(file File) (File, error) {
+		if launch != nil && filepath.Clean(launch.File) == filepath.Clean(file.Path) {
+			launch.FileID = file.ID
+		}
 		path, err := rewrite(out, file.Path)
 		if err != nil {
 			return file, err
 		}
 		file.Path = path
-		file.ID = id
-		id++
 		return file, nil
 	}); err != nil {
 		return err
 	}
+	if launch != nil && launch.FileID == "" {
+		return fmt.Errorf("launch file %q is not listed in the manifest", launch.File)
+	}
 	for i, s := range wixFile.Shortcuts {
 		if s.Icon != "" {
 			path, err := rewrite(out, s.Icon)
@@ -453,6 +1458,66 @@ func (wixFile *WixManifest) RewriteFilePaths(out string) error {
 			wixFile.Shortcuts[i].Icon = path
 		}
 	}
+	for i, l := range wixFile.Languages {
+		if l.License != "" {
+			path, err := rewrite(out, l.License)
+			if err != nil {
+				return err
+			}
+			wixFile.Languages[i].License = path
+		}
+	}
+	for i, m := range wixFile.MergeModules {
+		path, err := rewrite(out, m.Path)
+		if err != nil {
+			return err
+		}
+		wixFile.MergeModules[i].Path = path
+	}
+	if err := wixFile.bindMergeModules(); err != nil {
+		return err
+	}
+	if wixFile.Bundle != nil {
+		for i, pkg := range wixFile.Bundle.Packages {
+			path, err := rewrite(out, pkg.Path)
+			if err != nil {
+				return err
+			}
+			wixFile.Bundle.Packages[i].Path = path
+		}
+	}
+	return nil
+}
+
+// bindMergeModules attaches each merge module to the directory
+// it is merged into.
+func (wixFile *WixManifest) bindMergeModules() error {
+	wixFile.Directory.MergeModules = nil
+	if err := wixFile.walkDirectories(func(parent string, dir Directory) (Directory, error) {
+		dir.MergeModules = nil
+		return dir, nil
+	}); err != nil {
+		return err
+	}
+	for _, m := range wixFile.MergeModules {
+		dir := &wixFile.Directory
+		if m.Directory != "" {
+			for _, name := range strings.Split(filepath.ToSlash(m.Directory), "/") {
+				var sub *Directory
+				for i := range dir.Directories {
+					if dir.Directories[i].Name == name {
+						sub = &dir.Directories[i]
+						break
+					}
+				}
+				if sub == nil {
+					return fmt.Errorf("merge module %s: directory %q not found", m.ID, m.Directory)
+				}
+				dir = sub
+			}
+		}
+		dir.MergeModules = append(dir.MergeModules, m)
+	}
 	return nil
 }
 
@@ -478,14 +1543,7 @@ func validateCompression(wixFile *WixManifest) error {
 	return fmt.Errorf("invalid compression %q, must be one of %s", wixFile.Compression, strings.Join(compressions, ", "))
 }
 
-// Normalize appropriately fixes some values within the decoded json.
-// It applies defaults values on the wix/msi property to generate the msi package.
-// It applies defaults values on the choco property to generate a nuget package.
-func (wixFile *WixManifest) Normalize() error {
-	if err := validateCompression(wixFile); err != nil {
-		return err
-	}
-
+func (wixFile *WixManifest) normalizeVersion() error {
 	if wixFile.Version.Display == "" {
 		wixFile.Version.Display = wixFile.Version.User
 	}
@@ -518,6 +1576,20 @@ func (wixFile *WixManifest) Normalize() error {
 	} else {
 		return fmt.Errorf("Failed to parse version '%v', must be either a semantic version or a single build/revision number", wixFile.Version.User)
 	}
+	return nil
+}
+
+// Normalize appropriately fixes some values within the decoded json.
+// It applies defaults values on the wix/msi property to generate the msi package.
+// It applies defaults values on the choco property to generate a nuget package.
+func (wixFile *WixManifest) Normalize() error {
+	if err := validateCompression(wixFile); err != nil {
+		return err
+	}
+
+	if err := wixFile.normalizeVersion(); err != nil {
+		return err
+	}
 
 	if wixFile.Banner != "" {
 		path, err := filepath.Abs(wixFile.Banner)
@@ -541,6 +1613,69 @@ func (wixFile *WixManifest) Normalize() error {
 		wixFile.Icon = path
 	}
 
+	if wixFile.Bundle != nil {
+		if wixFile.Bundle.Name == "" {
+			wixFile.Bundle.Name = wixFile.Product
+		}
+		if wixFile.Bundle.Logo != "" {
+			path, err := filepath.Abs(wixFile.Bundle.Logo)
+			if err != nil {
+				return err
+			}
+			wixFile.Bundle.Logo = path
+		}
+		for i := range wixFile.Bundle.Searches {
+			s := &wixFile.Bundle.Searches[i]
+			var err error
+			if s.Root, s.Key, err = extractRegistry(s.Path); err != nil {
+				return err
+			}
+			if s.Result == "" {
+				s.Result = "value"
+			}
+		}
+		for i := range wixFile.Bundle.Packages {
+			p := &wixFile.Bundle.Packages[i]
+			if p.Vital == "" {
+				p.Vital = "yes"
+			}
+			if p.Permanent == "" {
+				p.Permanent = "no"
+			}
+		}
+	}
+
+	for i := range wixFile.Features {
+		if wixFile.Features[i].Level == 0 {
+			wixFile.Features[i].Level = 1
+		}
+	}
+	for i := range wixFile.MergeModules {
+		if wixFile.MergeModules[i].Language == "" {
+			wixFile.MergeModules[i].Language = "1033"
+		}
+	}
+
+	if err := wixFile.normalizeLanguages(); err != nil {
+		return err
+	}
+	if err := wixFile.normalizeDialogs(); err != nil {
+		return err
+	}
+	if wixFile.UI != nil && wixFile.UI.Launch != nil && wixFile.UI.Launch.Text == "" {
+		wixFile.UI.Launch.Text = "Launch " + wixFile.Product
+	}
+	if wixFile.Upgrade != nil {
+		for i := range wixFile.Upgrade.Legacy {
+			l := &wixFile.Upgrade.Legacy[i]
+			l.UpgradeCode = "{" + strings.ToUpper(strings.Trim(l.UpgradeCode, "{}")) + "}"
+			if l.Minimum == "" {
+				l.Minimum = "0.0.0"
+			}
+			l.Property = fmt.Sprintf("LEGACYPRODUCTS%d", i)
+		}
+	}
+
 	// choco fix
 	if wixFile.Choco.ID == "" {
 		wixFile.Choco.ID = wixFile.Product
@@ -560,10 +1695,6 @@ func (wixFile *WixManifest) Normalize() error {
 	wixFile.Choco.Tags += " admin" // required to pass chocolatey validation..
 
 	for i, hook := range wixFile.Hooks {
-		command, err := escapeHook(hook.Command)
-		if err != nil {
-			return err
-		}
 		if hook.Execute == "" {
 			hook.Execute = "deferred"
 		}
@@ -573,7 +1704,7 @@ func (wixFile *WixManifest) Normalize() error {
 				hook.Impersonate = "yes"
 			}
 		}
-		hook.CookedCommand = command
+		hook.CookedCommand = quoteHook(hook.Command)
 		wixFile.Hooks[i] = hook
 	}
 
@@ -626,22 +1757,22 @@ func (wixFile *WixManifest) Normalize() error {
 	}); err != nil {
 		return err
 	}
+	if wixFile.Info == nil {
+		wixFile.Info = &Info{}
+	}
 	wixFile.Info.Size = size >> 10
 
 	return wixFile.check()
 }
 
-func escapeHook(command string) (string, error) {
+// quoteHook quotes the program of a hook command, the templates escape it.
+func quoteHook(command string) string {
 	cmd := strings.Trim(command, " ")
 	if len(cmd) > 0 && cmd[0] != '"' {
 		words := strings.Split(cmd, " ")
 		cmd = `"` + words[0] + `"` + cmd[len(words[0]):]
 	}
-	buf := &bytes.Buffer{}
-	if err := xml.EscapeText(buf, []byte(cmd)); err != nil {
-		return "", err
-	}
-	return buf.String(), nil
+	return cmd
 }
 
 func extractRegistry(path string) (string, string, error) {
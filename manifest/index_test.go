@@ -1,7 +1,14 @@
 package manifest
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -113,6 +120,121 @@ func TestBuildDirectories(t *testing.T) {
 
 }
 
+func TestBuildDirectoriesPatterns(t *testing.T) {
+	parent := t.TempDir()
+	for _, f := range []string{"app.exe", "app.pdb", ".env", ".git/config", "config/a.yaml", "config/b.yaml~", "docs/readme.md"} {
+		p := filepath.Join(parent, "pkg", filepath.FromSlash(f))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, nil, 0644))
+	}
+	root := path.Join(filepath.ToSlash(parent), "pkg")
+
+	dir := Directory{
+		Name:    "pkg",
+		Exclude: []string{"**/*.pdb", "**/.*", "**/*~"},
+		Rules: []Rule{
+			{Pattern: "config/*.yaml", NeverOverwrite: true},
+			{Pattern: "*.exe", Service: &Service{Name: "app"}},
+			{Pattern: "**", Feature: "core"},
+		},
+	}
+	require.NoError(t, buildDirectories(filepath.ToSlash(parent), &dir))
+	require.Equal(t, []File{{Path: root + "/app.exe", Service: &Service{Name: "app"}, Feature: "core"}}, dir.Files)
+	require.Equal(t, []Directory{
+		{Name: "config", Files: []File{{Path: root + "/config/a.yaml", NeverOverwrite: true, Feature: "core"}}},
+		{Name: "docs", Files: []File{{Path: root + "/docs/readme.md", Feature: "core"}}},
+	}, dir.Directories)
+
+	dir = Directory{Name: "pkg", Include: []string{"**/*.yaml"}}
+	require.NoError(t, buildDirectories(filepath.ToSlash(parent), &dir))
+	require.Empty(t, dir.Files)
+	require.Equal(t, []Directory{{Name: "config", Files: []File{{Path: root + "/config/a.yaml"}}}}, dir.Directories)
+
+	dir = Directory{Name: "pkg", Rules: []Rule{{Pattern: "config/[a"}}}
+	require.EqualError(t, buildDirectories(filepath.ToSlash(parent), &dir), `Invalid "pattern" value in rule of directory pkg: config/[a`)
+}
+
+func TestLoadRelativePaths(t *testing.T) {
+	root := filepath.ToSlash(t.TempDir())
+	for _, f := range []string{"pkg/bin/hello.exe", "pkg/dist/data.txt", "pkg/LICENSE.rtf"} {
+		p := filepath.Join(root, filepath.FromSlash(f))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, nil, 0644))
+	}
+	manifest := path.Join(root, "pkg", "wix.json")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`{
+		"product": "hello",
+		"license": "LICENSE.rtf",
+		"files": [{"path": "bin/hello.exe"}],
+		"directories": [{"name": "dist"}],
+		"shortcuts": [{"name": "hello", "icon": "/abs/hello.ico"}]
+	}`), 0644))
+
+	wixFile := &WixManifest{}
+	require.NoError(t, wixFile.Load(manifest))
+	require.Equal(t, root+"/pkg/LICENSE.rtf", wixFile.License)
+	require.Equal(t, root+"/pkg/bin/hello.exe", wixFile.Files[0].Path)
+	require.Equal(t, root+"/pkg/dist/data.txt", wixFile.Directories[0].Files[0].Path)
+	require.Equal(t, "/abs/hello.ico", wixFile.Shortcuts[0].Icon)
+	require.NoFileExists(t, path.Join(root, "pkg", "wix.dynamic.json"))
+
+	// written back relative to the file
+	require.NoError(t, wixFile.Write(path.Join(root, "pkg", "copy.json")))
+	written := &WixManifest{}
+	byt, err := ioutil.ReadFile(path.Join(root, "pkg", "copy.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(byt, written))
+	require.Equal(t, "LICENSE.rtf", written.License)
+	require.Equal(t, "bin/hello.exe", written.Files[0].Path)
+	require.Equal(t, root+"/pkg/bin/hello.exe", wixFile.Files[0].Path)
+
+	wixFile = &WixManifest{BaseDir: path.Join(root, "pkg", "bin")}
+	require.Error(t, wixFile.Load(manifest))
+	require.NoError(t, os.MkdirAll(path.Join(root, "pkg", "bin", "dist"), 0755))
+	wixFile = &WixManifest{BaseDir: path.Join(root, "pkg", "bin")}
+	require.NoError(t, wixFile.Load(manifest))
+	require.Equal(t, root+"/pkg/bin/bin/hello.exe", wixFile.Files[0].Path)
+}
+
+func TestSyncFiles(t *testing.T) {
+	root := filepath.ToSlash(t.TempDir())
+	manifest := path.Join(root, "wix.json")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(`{
+		"product": "hello",
+		"files": [{"path": "build/hello.exe", "service": {"name": "hello", "start": "auto"}}],
+		"directories": [
+			{"name": "docs", "files": [{"path": "build/docs/old.txt"}]},
+			{"name": "assets"}
+		]
+	}`), 0644))
+
+	wixFile := &WixManifest{}
+	require.NoError(t, wixFile.Read(manifest))
+	require.Nil(t, wixFile.Directories[1].Files)
+
+	build := path.Join(root, "build")
+	added, removed := wixFile.SyncFiles(build, []string{"hello.exe", "docs/new.txt", "lib/a.dll"})
+	require.Equal(t, []File{{Path: build + "/docs/new.txt"}, {Path: build + "/lib/a.dll"}}, added)
+	require.Equal(t, []File{{Path: build + "/docs/old.txt"}}, removed)
+	require.Equal(t, "hello", wixFile.Files[0].Service.Name)
+	require.Equal(t, []Directory{
+		{Name: "docs", Files: []File{{Path: build + "/docs/new.txt"}}},
+		{Name: "assets"},
+		{Name: "lib", Files: []File{{Path: build + "/lib/a.dll"}}},
+	}, wixFile.Directories)
+
+	added, removed = wixFile.SyncFiles(build, []string{"hello.exe", "docs/new.txt", "lib/a.dll"})
+	require.Empty(t, added)
+	require.Empty(t, removed)
+
+	removed = wixFile.RemoveFiles(func(file File) bool {
+		rel, ok := RelPath(build, file.Path)
+		return ok && matchAny([]string{"lib/**"}, rel)
+	})
+	require.Equal(t, []File{{Path: build + "/lib/a.dll"}}, removed)
+	require.Len(t, wixFile.Directories, 2)
+}
+
 func TestEmptyDir(t *testing.T) {
 	wixFile := &WixManifest{}
 	d := Directory{Name: "fakedir"}
@@ -121,3 +243,573 @@ func TestEmptyDir(t *testing.T) {
 	err := wixFile.buildDirectoriesRecursive()
 	require.Error(t, err)
 }
+
+func TestBindMergeModules(t *testing.T) {
+	wixFile := &WixManifest{}
+	wixFile.Directories = []Directory{
+		{
+			Name: "assets",
+			Directories: []Directory{
+				{
+					Name: "vendor",
+				},
+			},
+		},
+	}
+	wixFile.MergeModules = []MergeModule{
+		{ID: "Root", Path: "root.msm"},
+		{ID: "Vendor", Path: "vendor.msm", Directory: "assets/vendor"},
+	}
+
+	err := wixFile.bindMergeModules()
+	require.NoError(t, err)
+	require.Equal(t, []MergeModule{wixFile.MergeModules[0]}, wixFile.Directory.MergeModules)
+	require.Empty(t, wixFile.Directories[0].MergeModules)
+	require.Equal(t, []MergeModule{wixFile.MergeModules[1]}, wixFile.Directories[0].Directories[0].MergeModules)
+
+	wixFile.MergeModules = append(wixFile.MergeModules, MergeModule{ID: "Missing", Path: "missing.msm", Directory: "missing"})
+	err = wixFile.bindMergeModules()
+	require.Error(t, err)
+}
+
+func TestCheckPatch(t *testing.T) {
+	release := func(version string, files ...string) *WixManifest {
+		wixFile := &WixManifest{
+			UpgradeCode: "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}",
+			ProductCode: "{0B2B5E8D-70F5-4C6B-9F2C-5B11B9E22B74}",
+		}
+		wixFile.Version.User = version
+		for _, f := range files {
+			wixFile.Files = append(wixFile.Files, File{Path: f})
+		}
+		return wixFile
+	}
+
+	err := CheckPatch(release("1.0.0", "a.exe"), release("1.0.1", "a.exe", "b.dll"), nil, nil, "minor")
+	require.NoError(t, err)
+
+	err = CheckPatch(release("1.0.0", "a.exe"), release("1.0.0", "a.exe"), nil, nil, "small")
+	require.NoError(t, err)
+
+	err = CheckPatch(release("1.0.0", "a.exe"), release("1.0.0", "a.exe"), nil, nil, "minor")
+	require.Error(t, err)
+
+	err = CheckPatch(release("1.0.0", "a.exe", "b.dll"), release("1.0.1", "b.dll"), nil, nil, "minor")
+	require.Equal(t, PatchErrors{"the file a.exe was removed"}, err)
+
+	newRelease := release("1.0.1", "a.exe")
+	newRelease.ProductCode = ""
+	err = CheckPatch(release("1.0.0", "a.exe"), newRelease, nil, nil, "minor")
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(dir, "a.exe"), []byte("a"), 0644)
+	require.NoError(t, err)
+	oldLock := &Lock{Files: []LockedFile{{Path: "a.exe", ID: "LOCKED"}}}
+	err = CheckPatch(release("1.0.0", filepath.Join(dir, "a.exe")), release("1.0.1", filepath.Join(dir, "a.exe")), oldLock, oldLock, "minor")
+	require.NoError(t, err)
+	err = CheckPatch(release("1.0.0", filepath.Join(dir, "a.exe")), release("1.0.1", filepath.Join(dir, "a.exe")), oldLock, &Lock{}, "minor")
+	require.Equal(t, PatchErrors{"the component of the file a.exe changed from ApplicationFilesLOCKED to ApplicationFiles" + stableID("a.exe")}, err)
+}
+
+func TestNormalizePatch(t *testing.T) {
+	// with --no-check the version is only normalized here
+	wixFile := &WixManifest{Product: "hello"}
+	wixFile.Version.User = "1.0.1"
+	require.NoError(t, wixFile.NormalizePatch())
+	require.Equal(t, "1.0.1", wixFile.Version.MSI)
+	require.Equal(t, &Patch{
+		Classification: "Hotfix",
+		DisplayName:    "hello 1.0.1",
+		Description:    "This patches hello to 1.0.1",
+	}, wixFile.Patch)
+
+	wixFile.Patch.Classification = "Bugfix"
+	require.Error(t, wixFile.NormalizePatch())
+}
+
+func TestApplyLock(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.exe": "a", "b.exe": "a", "c.dll": "c"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		require.NoError(t, err)
+	}
+	release := func(files ...string) *WixManifest {
+		wixFile := &WixManifest{UpgradeCode: "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}"}
+		for _, f := range files {
+			wixFile.Files = append(wixFile.Files, File{Path: filepath.Join(dir, f)})
+		}
+		return wixFile
+	}
+
+	lock, violations, err := release("a.exe", "c.dll").ApplyLock(&Lock{})
+	require.NoError(t, err)
+	require.Empty(t, violations)
+	require.Len(t, lock.Files, 2)
+	require.Equal(t, "a.exe", lock.Files[0].Path)
+	require.Equal(t, stableID("a.exe"), lock.Files[0].ID)
+
+	wixFile := release("a.exe", "c.dll")
+	lock.Files[1].ID = "LOCKED"
+	_, violations, err = wixFile.ApplyLock(lock)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+	require.Equal(t, "LOCKED", wixFile.Files[1].ID)
+
+	_, violations, err = release("b.exe").ApplyLock(lock)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"the file a.exe was moved or renamed to b.exe, its component changed from ApplicationFiles" + stableID("a.exe") + " to ApplicationFiles" + stableID("b.exe"),
+		"the file c.dll was removed along with its component ApplicationFilesLOCKED",
+	}, violations)
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	wixFile := &WixManifest{UpgradeCode: "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}"}
+	wixFile.Upgrade = &Upgrade{
+		Schedule: "afterInstallExecute",
+		Legacy:   []LegacyUpgrade{{UpgradeCode: "0B2B5E8D-70F5-4C6B-9F2C-5B11B9E22B74", Maximum: "2.0.0"}},
+	}
+	require.NoError(t, wixFile.checkUpgrade())
+
+	wixFile.Upgrade.Schedule = "later"
+	require.Error(t, wixFile.checkUpgrade())
+	wixFile.Upgrade.Schedule = ""
+
+	wixFile.Upgrade.AllowDowngrades = true
+	wixFile.Upgrade.DowngradeMessage = "No downgrade"
+	require.Error(t, wixFile.checkUpgrade())
+	wixFile.Upgrade.DowngradeMessage = ""
+
+	wixFile.Upgrade.Legacy[0].Maximum = "2.0.0-beta"
+	require.Error(t, wixFile.checkUpgrade())
+	wixFile.Upgrade.Legacy[0].Maximum = ""
+
+	wixFile.Upgrade.Legacy[0].UpgradeCode = "6e5b6bb3-0d1a-4e28-9ae4-6c4c22a2d05e"
+	require.Error(t, wixFile.checkUpgrade())
+}
+
+func TestBuilder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"hello.exe", "svc.exe"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		require.NoError(t, err)
+	}
+	hello := filepath.ToSlash(filepath.Join(dir, "hello.exe"))
+	svc := filepath.ToSlash(filepath.Join(dir, "svc.exe"))
+
+	b := NewBuilder("hello", "acme", "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}").
+		Version("1.0.0").
+		AddFile("", File{Path: hello}).
+		AddService("bin/svc", svc, Service{Name: "svc", Start: "auto"}).
+		AddShortcut(Shortcut{Name: "hello", Location: "program", Target: "[INSTALLDIR]hello.exe"}).
+		AddRegistry(RegistryItem{Registry: Registry{Path: `HKCU\Software\acme\hello`}}).
+		AddHook(Hook{Command: "[INSTALLDIR]hello.exe install", When: "install"}).
+		AddProperty("MODE", "quiet")
+	wixFile, err := b.Build()
+	require.NoError(t, err)
+	require.Equal(t, "bin", wixFile.Directories[0].Name)
+	require.Equal(t, "svc", wixFile.Directories[0].Directories[0].Name)
+	require.Empty(t, wixFile.Hooks[0].CookedCommand)
+
+	p := filepath.Join(dir, "wix.json")
+	require.NoError(t, b.Write(p))
+	expected, err := ioutil.ReadFile(p)
+	require.NoError(t, err)
+	loaded := &WixManifest{}
+	require.NoError(t, json.Unmarshal(expected, loaded))
+	byt, err := loaded.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(byt))
+
+	err = NewBuilder("hello", "acme", "").Version("1.0.0").AddFile("../bin", File{Path: hello}).Validate()
+	require.EqualError(t, err, `Invalid "dir" value in file: ../bin`)
+	err = NewBuilder("hello", "acme", "").Version("1.0.0").AddHook(Hook{Command: "hello", When: "never"}).Validate()
+	require.EqualError(t, err, `Invalid "when" value in hook: never`)
+}
+
+func TestReproducible(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.exe", "b.exe"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		require.NoError(t, err)
+	}
+	release := func(version string) *WixManifest {
+		wixFile := &WixManifest{UpgradeCode: "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}"}
+		wixFile.Version.User = version
+		wixFile.Files = []File{{Path: filepath.Join(dir, "b.exe")}, {Path: filepath.Join(dir, "a.exe")}}
+		wixFile.Directories = []Directory{{Name: "z"}, {Name: "y"}}
+		require.NoError(t, wixFile.normalizeVersion())
+		require.NoError(t, wixFile.SetReproducibleCodes("amd64"))
+		return wixFile
+	}
+
+	first, again, next := release("1.0.0"), release("1.0.0"), release("1.0.1")
+	require.Equal(t, first.ProductCode, again.ProductCode)
+	require.Equal(t, first.PackageCode, again.PackageCode)
+	require.NotEqual(t, first.ProductCode, next.ProductCode)
+	require.NotEqual(t, first.PackageCode, first.ProductCode)
+
+	first.SortFiles()
+	require.Equal(t, filepath.Join(dir, "a.exe"), first.Files[0].Path)
+	require.Equal(t, "y", first.Directories[0].Name)
+
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	staged := filepath.Join(dir, "staged")
+	require.NoError(t, first.StageFiles(staged, mtime))
+	require.Equal(t, filepath.Join(staged, "a.exe"), first.Files[0].Path)
+	info, err := os.Stat(first.Files[0].Path)
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(mtime))
+
+	wixFile := &WixManifest{UpgradeCode: "not a guid"}
+	require.EqualError(t, wixFile.SetReproducibleCodes(""), `Invalid "upgrade-code" value for a reproducible build: not a guid`)
+}
+
+func TestModuleGUID(t *testing.T) {
+	wixFile := &WixManifest{Kind: "module", UpgradeCode: "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}"}
+	require.NoError(t, wixFile.checkKind())
+	guid := wixFile.ModuleGUID()
+	require.NotEqual(t, wixFile.UpgradeCode, guid)
+	require.NotEqual(t, wixFile.ComponentGUID("INSTALLDIR"), guid)
+	require.Equal(t, guid, (&WixManifest{UpgradeCode: wixFile.UpgradeCode}).ModuleGUID())
+
+	wixFile.ModuleCode = "{0B2B5E8D-70F5-4C6B-9F2C-5B11B9E22B74}"
+	require.Equal(t, wixFile.ModuleCode, wixFile.ModuleGUID())
+	wixFile.ModuleCode = "not a guid"
+	require.EqualError(t, wixFile.checkKind(), `Invalid "module-code" value: not a guid`)
+
+	wixFile = &WixManifest{Kind: "module"}
+	require.Error(t, wixFile.checkKind())
+}
+
+func TestBundleChain(t *testing.T) {
+	exe := Package{ID: "VCRedist", Type: "exe", Path: "vc_redist.exe", DetectCondition: "VCRedistInstalled"}
+	tests := []struct {
+		name     string
+		packages []Package
+		msi      string
+		ids      []string
+		err      string
+	}{
+		{name: "msi chained last", packages: []Package{exe}, msi: "hello.msi", ids: []string{"VCRedist", MainPackageID}},
+		{name: "no msi", packages: []Package{exe}, ids: []string{"VCRedist"}},
+		{name: "msi only", msi: "hello.msi", ids: []string{MainPackageID}},
+		{
+			name:     "main package id taken",
+			packages: []Package{{ID: MainPackageID, Type: "msi", Path: "other.msi"}},
+			msi:      "hello.msi",
+			err:      `Invalid "id" value in bundle package, reserved for the --msi package: MainPackage`,
+		},
+		{
+			name:     "main package id free without msi",
+			packages: []Package{{ID: MainPackageID, Type: "msi", Path: "other.msi"}},
+			ids:      []string{MainPackageID},
+		},
+		{
+			name:     "duplicate id",
+			packages: []Package{exe, exe},
+			err:      `Duplicate "id" value in bundle package: VCRedist`,
+		},
+		{
+			name:     "exe without detect condition",
+			packages: []Package{{ID: "Setup", Type: "exe", Path: "setup.exe"}},
+			err:      `Missing "detect-condition" value in exe bundle package: Setup`,
+		},
+		{
+			name:     "command of an msi",
+			packages: []Package{{ID: "Companion", Type: "msi", Path: "companion.msi", InstallCommand: "/quiet"}},
+			err:      `Invalid command in msi bundle package: Companion`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wixFile := &WixManifest{Bundle: &Bundle{Packages: append([]Package{}, test.packages...)}}
+			err := func() error {
+				if test.msi != "" {
+					if err := wixFile.Bundle.ChainMsi(test.msi); err != nil {
+						return err
+					}
+				}
+				return wixFile.checkBundle()
+			}()
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			ids := []string{}
+			for _, pkg := range wixFile.Bundle.Packages {
+				ids = append(ids, pkg.ID)
+			}
+			require.Equal(t, test.ids, ids)
+		})
+	}
+}
+
+func TestNormalizeLanguages(t *testing.T) {
+	tests := []struct {
+		name     string
+		license  string
+		lang     Language
+		lcid     int
+		codepage int
+		langLic  string
+		err      string
+	}{
+		{name: "known culture", lang: Language{Culture: "fr-FR"}, lcid: 1036, codepage: 1252},
+		{name: "culture codepage", lang: Language{Culture: "ja-jp"}, lcid: 1041, codepage: 932},
+		{name: "explicit lcid", lang: Language{Culture: "xx-yy", LCID: 4096, Codepage: 65001}, lcid: 4096, codepage: 65001},
+		{name: "default license", license: "LICENSE.rtf", lang: Language{Culture: "de-de"}, lcid: 1031, codepage: 1252, langLic: "LICENSE.rtf"},
+		{name: "own license", license: "LICENSE.rtf", lang: Language{Culture: "de-de", License: "LIZENZ.rtf"}, lcid: 1031, codepage: 1252, langLic: "LIZENZ.rtf"},
+		{name: "missing culture", lang: Language{}, err: `Missing "culture" value in language`},
+		{name: "unknown culture", lang: Language{Culture: "xx-yy"}, err: `Unknown culture "xx-yy" in language, set its "lcid" value`},
+		{name: "license without default", lang: Language{Culture: "de-de", License: "LIZENZ.rtf"}, err: `The "license" value of language de-de requires a default license`},
+		{name: "too many conditions", lang: Language{Culture: "de-de", Conditions: []string{"Windows 10"}}, err: `Too many "conditions" values in language de-de`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wixFile := &WixManifest{License: test.license, Languages: []Language{test.lang}}
+			err := wixFile.normalizeLanguages()
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			lang := wixFile.Languages[0]
+			require.Equal(t, strings.ToLower(test.lang.Culture), lang.Culture)
+			require.Equal(t, test.lcid, lang.LCID)
+			require.Equal(t, test.codepage, lang.Codepage)
+			require.Equal(t, test.langLic, lang.License)
+		})
+	}
+
+	wixFile := &WixManifest{Languages: []Language{{Culture: "en-US"}, {Culture: "en-us"}}}
+	require.EqualError(t, wixFile.normalizeLanguages(), `Duplicate "culture" value in language: en-us`)
+}
+
+func TestDialogValid(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs []Input
+		valid  string
+	}{
+		{name: "no validation", inputs: []Input{{Label: "Name:", Property: "NAME"}}, valid: "1"},
+		{
+			name:   "required",
+			inputs: []Input{{Label: "Name:", Property: "NAME", Validation: &Validation{Required: true}}},
+			valid:  "(NAME)",
+		},
+		{
+			name:   "required checkbox",
+			inputs: []Input{{Label: "Agree", Property: "AGREE", Type: "checkbox", Validation: &Validation{Required: true}}},
+			valid:  "1",
+		},
+		{
+			name: "required and condition",
+			inputs: []Input{
+				{Label: "Name:", Property: "NAME", Validation: &Validation{Required: true}},
+				{Label: "Port:", Property: "PORT", Validation: &Validation{Condition: "PORT > 1024"}},
+			},
+			valid: "(NAME) AND (PORT > 1024)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.valid, Dialog{Inputs: test.inputs}.Valid())
+		})
+	}
+
+	checks := Dialog{Inputs: tests[3].inputs}.Checks()
+	require.Equal(t, []Check{
+		{Condition: "NAME", Message: "Name is required.", Failed: "NOT (NAME)", Order: 1},
+		{Condition: "PORT > 1024", Message: "Port is invalid.", Failed: "NOT (PORT > 1024) AND (NAME)", Order: 3},
+	}, checks)
+}
+
+func TestNormalizeDialogs(t *testing.T) {
+	text := Input{Label: "Name:", Property: "NAME"}
+	value := Value("world")
+	tests := []struct {
+		name       string
+		properties []Property
+		dialogs    []Dialog
+		err        string
+	}{
+		{name: "text", dialogs: []Dialog{{Inputs: []Input{text}}}},
+		{
+			name:    "dropdown",
+			dialogs: []Dialog{{Inputs: []Input{{Property: "MODE", Type: "dropdown", Options: []Option{{Value: "a"}, {Value: "b"}}}}}},
+		},
+		{name: "no inputs", dialogs: []Dialog{{ID: "EmptyDlg"}}, err: `Missing "inputs" value in dialog: EmptyDlg`},
+		{
+			name:    "duplicate id",
+			dialogs: []Dialog{{ID: "Dlg", Inputs: []Input{text}}, {ID: "Dlg", Inputs: []Input{{Property: "OTHER"}}}},
+			err:     `Duplicate "id" value in dialog: Dlg`,
+		},
+		{
+			name:    "private property",
+			dialogs: []Dialog{{Inputs: []Input{{Property: "Name"}}}},
+			err:     `Invalid "property" value in dialog CustomDlg0, it must be a public (uppercase) property: "Name"`,
+		},
+		{
+			name:       "property of the manifest",
+			properties: []Property{{ID: "NAME"}},
+			dialogs:    []Dialog{{Inputs: []Input{text}}},
+			err:        `Duplicate "property" value in dialog CustomDlg0: NAME`,
+		},
+		{
+			name:       "registry property of the manifest",
+			properties: []Property{{ID: "NAME", Registry: &Registry{Path: `HKLM\Software\Hello`}}},
+			dialogs:    []Dialog{{Inputs: []Input{text}}},
+		},
+		{
+			name:       "registry property of the manifest with a value",
+			properties: []Property{{ID: "NAME", Registry: &Registry{Path: `HKLM\Software\Hello`}, Value: &value}},
+			dialogs:    []Dialog{{Inputs: []Input{text}}},
+			err:        `Duplicate "property" value in dialog CustomDlg0: NAME`,
+		},
+		{
+			name:    "dropdown without options",
+			dialogs: []Dialog{{Inputs: []Input{{Property: "MODE", Type: "dropdown"}}}},
+			err:     `Missing "options" value in dropdown input: MODE`,
+		},
+		{
+			name:    "checkbox default",
+			dialogs: []Dialog{{Inputs: []Input{{Property: "AGREE", Type: "checkbox", Default: "yes"}}}},
+			err:     `Invalid "default" value in checkbox input AGREE, it must be empty or 1`,
+		},
+		{
+			name:    "invalid type",
+			dialogs: []Dialog{{Inputs: []Input{{Property: "DATE", Type: "date"}}}},
+			err:     `Invalid "type" value in input DATE: date`,
+		},
+		{
+			name: "too many inputs",
+			dialogs: []Dialog{{Inputs: []Input{
+				{Property: "A"}, {Property: "B"}, {Property: "C"}, {Property: "D"}, {Property: "E"}, {Property: "F"},
+			}}},
+			err: "Too many inputs in dialog CustomDlg0, split them into several dialogs",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wixFile := &WixManifest{Properties: test.properties, Dialogs: test.dialogs}
+			err := wixFile.normalizeDialogs()
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	wixFile := &WixManifest{Dialogs: []Dialog{{Inputs: []Input{
+		text,
+		{Property: "AGREE", Type: "checkbox"},
+		{Property: "MODE", Type: "dropdown", Options: []Option{{Value: "a"}}},
+	}}}}
+	require.NoError(t, wixFile.normalizeDialogs())
+	dialog := wixFile.Dialogs[0]
+	require.Equal(t, "CustomDlg0", dialog.ID)
+	require.Equal(t, "text", dialog.Inputs[0].Type)
+	require.Equal(t, []int{dialogTop, dialogTop + 36, dialogTop + 60}, []int{dialog.Inputs[0].Y, dialog.Inputs[1].Y, dialog.Inputs[2].Y})
+	require.Equal(t, "a", dialog.Inputs[2].Default)
+	require.Equal(t, "a", dialog.Inputs[2].Options[0].Text)
+
+	wixFile = &WixManifest{
+		Properties: []Property{{ID: "NAME", Registry: &Registry{Path: `HKLM\Software\Hello`}}},
+		Dialogs:    []Dialog{{Inputs: []Input{{Property: "NAME", Default: "world"}}}},
+	}
+	require.NoError(t, wixFile.normalizeDialogs())
+	require.NoError(t, wixFile.normalizeDialogs())
+	require.True(t, wixFile.Dialogs[0].Inputs[0].Searched)
+	require.True(t, wixFile.Properties[0].Edited)
+	require.Equal(t, "world", wixFile.Properties[0].Default)
+	require.Nil(t, wixFile.Properties[0].Value)
+}
+
+func TestUIMode(t *testing.T) {
+	dialogs := []Dialog{{ID: "ConfigDlg", Inputs: []Input{{Property: "NAME"}}}}
+	tests := []struct {
+		name    string
+		ui      *UI
+		license string
+		dialogs []Dialog
+		mode    string
+		seq     []string
+		err     string
+	}{
+		{name: "default", mode: "install-dir", seq: []string{"WelcomeDlg", "InstallDirDlg", "VerifyReadyDlg"}},
+		{name: "minimal", ui: &UI{Mode: "minimal"}, mode: "minimal", seq: []string{"WelcomeDlg", "VerifyReadyDlg"}},
+		{
+			name: "feature tree with license", ui: &UI{Mode: "feature-tree"}, license: "LICENSE.rtf", mode: "feature-tree",
+			seq: []string{"WelcomeDlg", "LicenseAgreementDlg_HK", "CustomizeDlg", "VerifyReadyDlg"},
+		},
+		{
+			name: "advanced with dialogs", ui: &UI{Mode: "advanced"}, dialogs: dialogs, mode: "advanced",
+			seq: []string{"WelcomeDlg", "ConfigDlg", "InstallDirDlg", "CustomizeDlg", "VerifyReadyDlg"},
+		},
+		{name: "none", ui: &UI{Mode: "none"}, mode: "none"},
+		{name: "none with dialogs", ui: &UI{Mode: "none"}, dialogs: dialogs, mode: "none", err: "dialogs are not supported without user interface"},
+		{
+			name: "none with launch", ui: &UI{Mode: "none", Launch: &Launch{File: "hello.exe"}}, mode: "none",
+			err: "launch is not supported without user interface",
+		},
+		{name: "invalid", ui: &UI{Mode: "full"}, mode: "full", err: `Invalid "mode" value in ui: full`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wixFile := &WixManifest{UI: test.ui, License: test.license, Dialogs: test.dialogs}
+			require.Equal(t, test.mode, wixFile.UIMode())
+			err := wixFile.checkUI()
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.seq, wixFile.UISequence())
+		})
+	}
+}
+
+func TestLaunchFileID(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"hello.exe", "helper.exe"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	tests := []struct {
+		name   string
+		launch string
+		want   string
+		err    string
+	}{
+		{name: "listed file", launch: filepath.Join(dir, "helper.exe"), want: "helper.exe"},
+		{name: "unclean path", launch: filepath.Join(dir, ".", "hello.exe"), want: "hello.exe"},
+		{
+			name:   "unlisted file",
+			launch: filepath.Join(dir, "other.exe"),
+			err:    `launch file "` + filepath.Join(dir, "other.exe") + `" is not listed in the manifest`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wixFile := &WixManifest{UI: &UI{Launch: &Launch{File: test.launch}}}
+			wixFile.Files = []File{{Path: filepath.Join(dir, "hello.exe")}, {Path: filepath.Join(dir, "helper.exe")}}
+			err := wixFile.RewriteFilePaths(t.TempDir())
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			var id string
+			for _, file := range wixFile.Files {
+				if file.InstallPath == test.want {
+					id = file.ID
+				}
+			}
+			require.NotEmpty(t, id)
+			require.Equal(t, id, wixFile.UI.Launch.FileID)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/observiq/go-msi/util"
+)
+
+// Lock records the identifiers given to the directories and files of
+// a release, so that the next releases keep them.
+type Lock struct {
+	Directories []LockedDirectory `json:"directories"`
+	Files       []LockedFile      `json:"files"`
+}
+
+// LockedDirectory is a directory recorded in the lock file.
+type LockedDirectory struct {
+	Path string `json:"path"` // relative to the install directory
+	ID   string `json:"id"`
+}
+
+// LockedFile is a file recorded in the lock file.
+type LockedFile struct {
+	Path   string `json:"path"` // relative to the install directory
+	ID     string `json:"id"`
+	GUID   string `json:"guid,omitempty"`
+	Sha256 string `json:"sha256"`
+}
+
+// LoadLock reads a lock file, it returns an empty lock if the file
+// does not exist.
+func LoadLock(p string) (*Lock, error) {
+	lock := &Lock{}
+	dat, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(dat, lock); err != nil {
+		return nil, fmt.Errorf("JSON Unmarshal of %s failed with %v", p, err)
+	}
+	return lock, nil
+}
+
+// Save writes the lock file, unless it is up to date.
+func (lock *Lock) Save(p string) error {
+	dat, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	dat = append(dat, '\n')
+	if old, err := ioutil.ReadFile(p); err == nil && bytes.Equal(old, dat) {
+		return nil
+	}
+	return ioutil.WriteFile(p, dat, 0644)
+}
+
+// ApplyLock gives the directories and files their locked identifiers,
+// it must be called before RewriteFilePaths. It returns the lock of
+// the manifest and the component rules violated since the locked release:
+// the files moved, renamed or removed.
+func (wixFile *WixManifest) ApplyLock(lock *Lock) (*Lock, []string, error) {
+	dirs := make(map[string]string)
+	for _, d := range lock.Directories {
+		dirs[d.Path] = d.ID
+	}
+	files := make(map[string]LockedFile)
+	for _, f := range lock.Files {
+		files[f.Path] = f
+	}
+
+	// the ids are computed first to know the install paths
+	if err := wixFile.AssignIDs(); err != nil {
+		return nil, nil, err
+	}
+	wixFile.walkDirectories(func(parent string, dir Directory) (Directory, error) {
+		if id, ok := dirs[dir.InstallPath]; ok {
+			dir.ID = id
+		}
+		return dir, nil
+	})
+	newLock := &Lock{}
+	if err := wixFile.walkFiles(func(file File) (File, error) {
+		if f, ok := files[file.InstallPath]; ok {
+			file.ID = f.ID
+			if f.GUID != "" {
+				file.GUID = f.GUID
+			}
+		}
+		sum, err := util.ComputeSha256(file.Path)
+		if err != nil {
+			return file, err
+		}
+		newLock.Files = append(newLock.Files, LockedFile{
+			Path:   file.InstallPath,
+			ID:     file.ID,
+			GUID:   file.GUID,
+			Sha256: sum,
+		})
+		return file, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	// ensure the locked ids do not collide with the new ones
+	if err := wixFile.AssignIDs(); err != nil {
+		return nil, nil, err
+	}
+	wixFile.walkDirectories(func(parent string, dir Directory) (Directory, error) {
+		newLock.Directories = append(newLock.Directories, LockedDirectory{
+			Path: dir.InstallPath,
+			ID:   dir.ID,
+		})
+		return dir, nil
+	})
+	sort.Slice(newLock.Directories, func(i, j int) bool {
+		return newLock.Directories[i].Path < newLock.Directories[j].Path
+	})
+	sort.Slice(newLock.Files, func(i, j int) bool {
+		return newLock.Files[i].Path < newLock.Files[j].Path
+	})
+
+	added := make(map[string][]LockedFile)
+	for _, f := range newLock.Files {
+		if _, ok := files[f.Path]; !ok {
+			added[f.Sha256] = append(added[f.Sha256], f)
+		}
+		delete(files, f.Path)
+	}
+	var violations []string
+	for _, f := range lock.Files {
+		if _, ok := files[f.Path]; !ok {
+			continue
+		}
+		if moved := added[f.Sha256]; len(moved) > 0 {
+			violations = append(violations, fmt.Sprintf("the file %s was moved or renamed to %s, its component changed from ApplicationFiles%s to ApplicationFiles%s", f.Path, moved[0].Path, f.ID, moved[0].ID))
+			added[f.Sha256] = moved[1:]
+		} else {
+			violations = append(violations, fmt.Sprintf("the file %s was removed along with its component ApplicationFiles%s", f.Path, f.ID))
+		}
+	}
+	return newLock, violations, nil
+}
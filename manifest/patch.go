@@ -0,0 +1,139 @@
+package manifest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Patch describes the metadata of the patches made from the manifest.
+type Patch struct {
+	Classification string `json:"classification,omitempty"` // Hotfix (default if omitted), Critical Update, Security Rollup, Service Pack, Update or Update Rollup
+	Description    string `json:"description,omitempty"`
+	DisplayName    string `json:"display-name,omitempty"`
+	MoreInfoURL    string `json:"more-info-url,omitempty"`
+	AllowRemoval   bool   `json:"allow-removal,omitempty"`
+}
+
+// PatchErrors lists the reasons why a patch can not be made between
+// two releases.
+type PatchErrors []string
+
+func (e PatchErrors) Error() string {
+	return "The patch would violate the component rules:\n- " + strings.Join(e, "\n- ")
+}
+
+// NormalizePatch applies defaults values on the patch metadata,
+// the version of the manifest must be set.
+func (wixFile *WixManifest) NormalizePatch() error {
+	if err := wixFile.normalizeVersion(); err != nil {
+		return err
+	}
+	if wixFile.Patch == nil {
+		wixFile.Patch = &Patch{}
+	}
+	p := wixFile.Patch
+	switch p.Classification {
+	case "":
+		p.Classification = "Hotfix"
+	case "Hotfix", "Critical Update", "Security Rollup", "Service Pack", "Update", "Update Rollup":
+	default:
+		return fmt.Errorf(`Invalid "classification" value in patch: %s`, p.Classification)
+	}
+	if p.DisplayName == "" {
+		p.DisplayName = fmt.Sprintf("%s %s", wixFile.Product, wixFile.Version.Display)
+	}
+	if p.Description == "" {
+		p.Description = fmt.Sprintf("This patches %s to %s", wixFile.Product, wixFile.Version.Display)
+	}
+	return nil
+}
+
+// CheckPatch verifies a patch of the given kind (small or minor) can be
+// made from the old release to the new one. Both manifests must have
+// their version set, the files get the identifiers of the lock of their
+// release when it is not nil.
+func CheckPatch(old, new *WixManifest, oldLock, newLock *Lock, kind string) error {
+	locks := []*Lock{oldLock, newLock}
+	for i, m := range []*WixManifest{old, new} {
+		if err := m.normalizeVersion(); err != nil {
+			return err
+		}
+		if locks[i] == nil {
+			if err := m.AssignIDs(); err != nil {
+				return err
+			}
+		} else if _, _, err := m.ApplyLock(locks[i]); err != nil {
+			return err
+		}
+	}
+
+	var errs PatchErrors
+	if old.UpgradeCode != new.UpgradeCode {
+		errs = append(errs, fmt.Sprintf("the upgrade code changed from %s to %s", old.UpgradeCode, new.UpgradeCode))
+	}
+	if old.ProductCode == "" || new.ProductCode == "" {
+		errs = append(errs, `the product code must be set with "product-code" in both manifests`)
+	} else if !strings.EqualFold(old.ProductCode, new.ProductCode) {
+		errs = append(errs, fmt.Sprintf("the product code changed from %s to %s, which requires a major upgrade", old.ProductCode, new.ProductCode))
+	}
+	switch kind {
+	case "small":
+		if old.Version.MSI != new.Version.MSI {
+			errs = append(errs, fmt.Sprintf("a small update must keep the version %s, got %s", old.Version.MSI, new.Version.MSI))
+		}
+	case "minor":
+		if new.Version.Hex <= old.Version.Hex {
+			errs = append(errs, fmt.Sprintf("a minor upgrade must increase the version %s, got %s", old.Version.MSI, new.Version.MSI))
+		}
+	default:
+		return fmt.Errorf("invalid patch kind %q, must be one of small, minor", kind)
+	}
+
+	files := make(map[string]File)
+	new.walkFiles(func(file File) (File, error) {
+		files[file.InstallPath] = file
+		return file, nil
+	})
+	old.walkFiles(func(file File) (File, error) {
+		f, ok := files[file.InstallPath]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("the file %s was removed", file.InstallPath))
+		} else if f.ID != file.ID {
+			errs = append(errs, fmt.Sprintf("the component of the file %s changed from ApplicationFiles%s to ApplicationFiles%s", file.InstallPath, file.ID, f.ID))
+		} else if !strings.EqualFold(f.GUID, file.GUID) {
+			errs = append(errs, fmt.Sprintf("the guid of the component of the file %s changed from %s to %s", file.InstallPath, file.GUID, f.GUID))
+		}
+		return file, nil
+	})
+
+	features := make(map[string]bool)
+	for _, f := range new.Features {
+		features[f.ID] = true
+	}
+	for _, f := range old.Features {
+		if !features[f.ID] {
+			errs = append(errs, fmt.Sprintf("the feature %s was removed", f.ID))
+		}
+		delete(features, f.ID)
+	}
+	if kind == "small" {
+		for id := range features {
+			errs = append(errs, fmt.Sprintf("the feature %s was added, which requires a minor upgrade", id))
+		}
+	}
+
+	modules := make(map[string]bool)
+	for _, m := range new.MergeModules {
+		modules[m.ID] = true
+	}
+	for _, m := range old.MergeModules {
+		if !modules[m.ID] {
+			errs = append(errs, fmt.Sprintf("the merge module %s was removed", m.ID))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/observiq/go-msi/util"
+)
+
+// SetReproducibleCodes derives the product code, unless fixed by the
+// manifest, and the package code from the upgrade code, the version and
+// the architecture, so that rebuilding a release gives the same codes.
+func (wixFile *WixManifest) SetReproducibleCodes(arch string) error {
+	namespace, err := uuid.Parse(wixFile.UpgradeCode)
+	if err != nil {
+		return fmt.Errorf(`Invalid "upgrade-code" value for a reproducible build: %s`, wixFile.UpgradeCode)
+	}
+	code := func(kind string) string {
+		name := fmt.Sprintf("%s %s %s", kind, wixFile.Version.MSI, arch)
+		return "{" + strings.ToUpper(uuid.NewSHA1(namespace, []byte(name)).String()) + "}"
+	}
+	if wixFile.ProductCode == "" {
+		wixFile.ProductCode = code("product")
+	}
+	wixFile.PackageCode = code("package")
+	return nil
+}
+
+// SortFiles sorts the files by path and the directories by name,
+// the order of the manifest becomes independent of the order of the
+// directory walk.
+func (wixFile *WixManifest) SortFiles() {
+	wixFile.Directory.sortFiles()
+}
+
+func (dir *Directory) sortFiles() {
+	sort.SliceStable(dir.Files, func(i, j int) bool {
+		return filepath.ToSlash(dir.Files[i].Path) < filepath.ToSlash(dir.Files[j].Path)
+	})
+	sort.SliceStable(dir.Directories, func(i, j int) bool {
+		return dir.Directories[i].Name < dir.Directories[j].Name
+	})
+	for i := range dir.Directories {
+		dir.Directories[i].sortFiles()
+	}
+}
+
+// StageFiles copies the files into dir, under their install path, with
+// the modification time mtime and makes the manifest point to the copies,
+// the timestamps of the cabinets then no longer depend on the sources.
+func (wixFile *WixManifest) StageFiles(dir string, mtime time.Time) error {
+	if err := wixFile.AssignIDs(); err != nil {
+		return err
+	}
+	var launch *Launch
+	if wixFile.UI != nil && wixFile.UI.Launch != nil {
+		launch = wixFile.UI.Launch
+	}
+	return wixFile.walkFiles(func(file File) (File, error) {
+		dst := filepath.Join(dir, filepath.FromSlash(file.InstallPath))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return file, err
+		}
+		if err := util.CopyFile(dst, file.Path); err != nil {
+			return file, err
+		}
+		if err := os.Chtimes(dst, mtime, mtime); err != nil {
+			return file, err
+		}
+		if launch != nil && filepath.Clean(launch.File) == filepath.Clean(file.Path) {
+			launch.File = dst
+		}
+		file.Path = dst
+		return file, nil
+	})
+}
@@ -1,19 +1,28 @@
 package msi
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/bmatcuk/doublestar"
 	"github.com/mh-cbon/stringexec"
+	"github.com/observiq/go-msi/builder"
 	"github.com/observiq/go-msi/manifest"
 	"github.com/observiq/go-msi/rtf"
+	"github.com/observiq/go-msi/sbom"
+	"github.com/observiq/go-msi/scaffold"
 	"github.com/observiq/go-msi/templates"
 	"github.com/observiq/go-msi/util"
 	"github.com/observiq/go-msi/wix"
@@ -23,20 +32,9 @@ import (
 // Version holds the program version.
 var Version = "0.0.0"
 
-// TPLPATH points to the template directory on the target system.
-// Should be used only for non windows systems to indicate template locations.
-var TPLPATH = "" // non-windows build, use ldflags to tell about that.
-
 // Main exposes the application entry point.
 func Main() {
 
-	if TPLPATH == "" { // built for windows
-		b, err := util.GetBinPath()
-		if err != nil {
-			panic(err)
-		}
-		TPLPATH = b
-	}
 	tmpBuildDir, err := ioutil.TempDir("", "go-msi")
 	if err != nil {
 		panic(err)
@@ -53,6 +51,59 @@ func Main() {
 			Usage:  "Provide a report about your environment setup",
 			Action: checkEnv,
 		},
+		{
+			Name:   "init",
+			Usage:  "Write a starter wix manifest for a Go module",
+			Action: initManifest,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path, p",
+					Value: "wix.json",
+					Usage: "Path to the wix manifest file to write",
+				},
+				cli.StringFlag{
+					Name:  "dir, d",
+					Value: ".",
+					Usage: "Directory of the go.mod file",
+				},
+				cli.StringSliceFlag{
+					Name:  "main, m",
+					Usage: "Directory of a main package to install, relative to --dir (default: all of them)",
+				},
+				cli.StringFlag{
+					Name:  "product",
+					Usage: "Product name (default: name of the module)",
+				},
+				cli.StringFlag{
+					Name:  "company",
+					Usage: "Company name (default: owner of the module)",
+				},
+				cli.StringFlag{
+					Name:  "service",
+					Usage: "Name of the service running the program named after it or the first one, none if empty",
+				},
+				cli.StringFlag{
+					Name:  "license, l",
+					Usage: "Path to the license file, none if empty (default: the LICENSE file of --dir)",
+				},
+				cli.BoolFlag{
+					Name:  "license-rtf",
+					Usage: "Convert the license to a RTF file next to it",
+				},
+				cli.BoolTFlag{
+					Name:  "shortcut",
+					Usage: "Add a start menu shortcut to the first program, disable with --shortcut=false",
+				},
+				cli.BoolFlag{
+					Name:  "yes, y",
+					Usage: "Do not ask for the values of the unset flags, use the proposals",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Overwrite the existing files",
+				},
+			},
+		},
 		{
 			Name:   "add-files",
 			Usage:  "Adds files from your wix manifest",
@@ -77,7 +128,64 @@ func Main() {
 				},
 				cli.BoolFlag{
 					Name:  "test, t",
-					Usage: "Test mode, does not modify the wix manifest file but exits with an error instead",
+					Usage: "Test mode, does not modify the wix manifest file but prints the changes and exits with an error if any",
+				},
+			},
+		},
+		{
+			Name:   "remove-files",
+			Usage:  "Removes files from your wix manifest",
+			Action: removeFiles,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path, p",
+					Value: "wix.json",
+					Usage: "Path to the wix manifest file",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Value: ".",
+					Usage: "Base directory of the patterns",
+				},
+				cli.StringSliceFlag{
+					Name:  "includes, i",
+					Usage: "Comma separated list of listed files to remove, use of * and ** is permitted",
+				},
+				cli.StringSliceFlag{
+					Name:  "excludes, e",
+					Usage: "Comma separated list of listed files to keep, use of * and ** is permitted",
+				},
+				cli.BoolFlag{
+					Name:  "test, t",
+					Usage: "Test mode, does not modify the wix manifest file but prints the changes and exits with an error if any",
+				},
+			},
+		},
+		{
+			Name:   "sync-files",
+			Usage:  "Adds and removes the files of your wix manifest to match a directory",
+			Action: syncFiles,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path, p",
+					Value: "wix.json",
+					Usage: "Path to the wix manifest file",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "Directory of the files to list",
+				},
+				cli.StringSliceFlag{
+					Name:  "includes, i",
+					Usage: "Comma separated list of files to list, use of * and ** is permitted (default: all of them)",
+				},
+				cli.StringSliceFlag{
+					Name:  "excludes, e",
+					Usage: "Comma separated list of files to leave out, use of * and ** is permitted",
+				},
+				cli.BoolFlag{
+					Name:  "test, t",
+					Usage: "Test mode, does not modify the wix manifest file but prints the changes and exits with an error if any",
 				},
 			},
 		},
@@ -107,16 +215,37 @@ func Main() {
 					Value: "wix.json",
 					Usage: "Path to the wix manifest file",
 				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
+				cli.BoolFlag{
+					Name:  "debug-manifest",
+					Usage: "Write the loaded wix manifest along with the discovered files to wix.dynamic.json",
+				},
 				cli.StringFlag{
 					Name:  "src, s",
-					Value: filepath.Join(TPLPATH, "templates"),
-					Usage: "Directory path to the wix templates files",
+					Usage: "Directory path to the templates overriding the embedded defaults",
+				},
+				cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Read the downloads of the templates from the cache instead of the network",
 				},
 				cli.StringFlag{
 					Name:  "out, o",
 					Value: tmpBuildDir,
 					Usage: "Directory path to the generated wix templates files",
 				},
+				cli.StringFlag{
+					Name:  "kind",
+					Value: "product",
+					Usage: "The kind of package to make, product (msi) or module (msm)",
+				},
+				cli.StringFlag{
+					Name:  "toolset, t",
+					Value: "auto",
+					Usage: "The WiX toolset, wix3 (candle and light), wix4 (wix build), wixl or auto",
+				},
 				cli.StringFlag{
 					Name:  "version",
 					Usage: "The version of your program",
@@ -133,6 +262,14 @@ func Main() {
 					Name:  "property, pr",
 					Usage: "A property to set defined as Id=Value",
 				},
+				cli.BoolFlag{
+					Name:  "update-lock",
+					Usage: "Accept the component rule violations and record them in wix.lock instead of failing",
+				},
+				cli.BoolFlag{
+					Name:  "eject",
+					Usage: "Write the embedded default templates to the out directory instead, --out must be set",
+				},
 			},
 		},
 		{
@@ -171,22 +308,30 @@ func Main() {
 		},
 		{
 			Name:   "gen-wix-cmd",
-			Usage:  "Generate a batch file of Wix commands to run",
+			Usage:  "Generate a script of Wix commands to run",
 			Action: generateWixCommands,
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "bin, b",
 					Usage: "Path to the wix binaries (if not in PATH)",
 				},
+				cli.StringFlag{
+					Name:  "toolset, t",
+					Value: "auto",
+					Usage: "The WiX toolset, wix3 (candle and light), wix4 (wix build), wixl or auto",
+				},
 				cli.StringFlag{
 					Name:  "path, p",
 					Value: "wix.json",
 					Usage: "Path to the wix manifest file",
 				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
 				cli.StringFlag{
 					Name:  "src, s",
-					Value: filepath.Join(TPLPATH, "templates"),
-					Usage: "Directory path to the wix templates files",
+					Usage: "Directory path to the templates overriding the embedded defaults",
 				},
 				cli.StringFlag{
 					Name:  "out, o",
@@ -197,15 +342,25 @@ func Main() {
 					Name:  "arch, a",
 					Usage: "A target architecture, amd64 or 386 (ia64 is not handled)",
 				},
+				cli.StringFlag{
+					Name:  "kind",
+					Value: "product",
+					Usage: "The kind of package to make, product (msi) or module (msm)",
+				},
 				cli.StringFlag{
 					Name:  "msi, m",
 					Usage: "Path to write resulting msi file to",
 				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "bat",
+					Usage: "The format of the script, bat, sh or ps1",
+				},
 			},
 		},
 		{
 			Name:   "run-wix-cmd",
-			Usage:  "Run the batch file of Wix commands",
+			Usage:  "Run the Wix commands generated by gen-wix-cmd",
 			Action: runWixCommands,
 			Flags: []cli.Flag{
 				cli.StringFlag{
@@ -215,6 +370,84 @@ func Main() {
 				},
 			},
 		},
+		{
+			Name:   "render",
+			Usage:  "Print the generated wix files and the commands to run without running them",
+			Action: render,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "toolset, t",
+					Value: "auto",
+					Usage: "The WiX toolset, wix3 (candle and light), wix4 (wix build), wixl or auto",
+				},
+				cli.StringFlag{
+					Name:  "path, p",
+					Value: "wix.json",
+					Usage: "Path to the wix manifest file",
+				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
+				cli.BoolFlag{
+					Name:  "debug-manifest",
+					Usage: "Write the loaded wix manifest along with the discovered files to wix.dynamic.json",
+				},
+				cli.StringFlag{
+					Name:  "src, s",
+					Usage: "Directory path to the templates overriding the embedded defaults",
+				},
+				cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Read the downloads of the templates from the cache instead of the network",
+				},
+				cli.StringFlag{
+					Name:  "out, o",
+					Usage: "Directory path to write the generated wix files to, they are printed if empty",
+				},
+				cli.StringFlag{
+					Name:  "arch, a",
+					Usage: "A target architecture, amd64 or 386 (ia64 is not handled)",
+				},
+				cli.StringFlag{
+					Name:  "kind",
+					Value: "product",
+					Usage: "The kind of package to make, product (msi) or module (msm)",
+				},
+				cli.StringFlag{
+					Name:  "msi, m",
+					Usage: "Path to write resulting msi file to",
+				},
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "The version of your program",
+				},
+				cli.StringFlag{
+					Name:  "display",
+					Usage: "The display version of your program",
+				},
+				cli.StringFlag{
+					Name:  "license, l",
+					Usage: "Path to the license file",
+				},
+				cli.StringSliceFlag{
+					Name:  "property, pr",
+					Usage: "A property to set defined as Id=Value",
+				},
+				cli.BoolFlag{
+					Name:  "pretty",
+					Usage: "Pretty print the generated wix files",
+				},
+				cli.BoolFlag{
+					Name:  "validate",
+					Usage: "Check that the generated wix files are well formed",
+				},
+				cli.BoolFlag{
+					Name:  "update-lock",
+					Usage: "Accept the component rule violations instead of failing, wix.lock is not written",
+				},
+			},
+		},
 		{
 			Name:   "make",
 			Usage:  "All-in-one command to make MSI files",
@@ -224,15 +457,31 @@ func Main() {
 					Name:  "bin, b",
 					Usage: "Path to the wix binaries (if not in PATH)",
 				},
+				cli.StringFlag{
+					Name:  "toolset, t",
+					Value: "auto",
+					Usage: "The WiX toolset, wix3 (candle and light), wix4 (wix build), wixl or auto",
+				},
 				cli.StringFlag{
 					Name:  "path, p",
 					Value: "wix.json",
 					Usage: "Path to the wix manifest file",
 				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
+				cli.BoolFlag{
+					Name:  "debug-manifest",
+					Usage: "Write the loaded wix manifest along with the discovered files to wix.dynamic.json",
+				},
 				cli.StringFlag{
 					Name:  "src, s",
-					Value: filepath.Join(TPLPATH, "templates"),
-					Usage: "Directory path to the wix templates files",
+					Usage: "Directory path to the templates overriding the embedded defaults",
+				},
+				cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Read the downloads of the templates from the cache instead of the network",
 				},
 				cli.StringFlag{
 					Name:  "out, o",
@@ -243,6 +492,11 @@ func Main() {
 					Name:  "arch, a",
 					Usage: "A target architecture, amd64 or 386 (ia64 is not handled)",
 				},
+				cli.StringFlag{
+					Name:  "kind",
+					Value: "product",
+					Usage: "The kind of package to make, product (msi) or module (msm)",
+				},
 				cli.StringFlag{
 					Name:  "msi, m",
 					Usage: "Path to write resulting msi file to",
@@ -267,6 +521,207 @@ func Main() {
 					Name:  "keep, k",
 					Usage: "Keep output directory containing build files (useful for debug)",
 				},
+				cli.StringFlag{
+					Name:  "cache-dir",
+					Value: builder.DefaultCacheDir(),
+					Usage: "Directory path to the cache of the built packages",
+				},
+				cli.BoolFlag{
+					Name:  "no-cache",
+					Usage: "Build the package even if nothing changed since a cached build",
+				},
+				cli.BoolFlag{
+					Name:  "reproducible",
+					Usage: "Build the same package from the same inputs, dated by SOURCE_DATE_EPOCH",
+				},
+				cli.BoolFlag{
+					Name:  "update-lock",
+					Usage: "Accept the component rule violations and record them in wix.lock instead of failing",
+				},
+				cli.StringFlag{
+					Name:  "sbom",
+					Usage: "Path to write the software bill of materials of the package to",
+				},
+				cli.StringFlag{
+					Name:  "sbom-format",
+					Value: "cyclonedx",
+					Usage: "The format of the software bill of materials, cyclonedx or spdx",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "Path to write the JSON report of the build to",
+				},
+			},
+		},
+		{
+			Name:   "sbom",
+			Usage:  "Write the software bill of materials of the files and Go modules of the package",
+			Action: writeSbom,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path, p",
+					Value: "wix.json",
+					Usage: "Path to the wix manifest file",
+				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "The version of your program",
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "cyclonedx",
+					Usage: "The format of the software bill of materials, cyclonedx or spdx",
+				},
+				cli.StringFlag{
+					Name:  "out, o",
+					Value: "sbom.json",
+					Usage: "Path to write the software bill of materials to",
+				},
+			},
+		},
+		{
+			Name:   "bundle",
+			Usage:  "All-in-one command to make a setup executable chaining prerequisites and MSI files",
+			Action: bundleMake,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bin, b",
+					Usage: "Path to the wix binaries (if not in PATH)",
+				},
+				cli.StringFlag{
+					Name:  "toolset, t",
+					Value: "auto",
+					Usage: "The WiX toolset, wix3 (candle and light), wix4 (wix build), wixl or auto",
+				},
+				cli.StringFlag{
+					Name:  "path, p",
+					Value: "wix.json",
+					Usage: "Path to the wix manifest file",
+				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
+				cli.StringFlag{
+					Name:  "src, s",
+					Usage: "Directory path to the templates overriding the embedded defaults, its bundle sub directory is used",
+				},
+				cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Read the downloads of the templates from the cache instead of the network",
+				},
+				cli.StringFlag{
+					Name:  "out, o",
+					Value: tmpBuildDir,
+					Usage: "Directory path to the generated wix cmd file",
+				},
+				cli.StringFlag{
+					Name:  "arch, a",
+					Usage: "A target architecture, amd64 or 386 (ia64 is not handled)",
+				},
+				cli.StringFlag{
+					Name:  "msi, m",
+					Usage: "Path to the msi file to chain after the bundle packages",
+				},
+				cli.StringFlag{
+					Name:  "exe, e",
+					Usage: "Path to write resulting setup executable to",
+				},
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "The version of your program",
+				},
+				cli.StringFlag{
+					Name:  "license, l",
+					Usage: "Path to the license file",
+				},
+				cli.BoolFlag{
+					Name:  "keep, k",
+					Usage: "Keep output directory containing build files (useful for debug)",
+				},
+			},
+		},
+		{
+			Name:   "patch",
+			Usage:  "Make a msp patch upgrading a previous msi release to the new one",
+			Action: patchMake,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bin, b",
+					Usage: "Path to the wix binaries (if not in PATH)",
+				},
+				cli.StringFlag{
+					Name:  "toolset, t",
+					Value: "auto",
+					Usage: "The WiX toolset, wix3 (candle and light), wix4 (wix build), wixl or auto",
+				},
+				cli.StringFlag{
+					Name:  "path, p",
+					Value: "wix.json",
+					Usage: "Path to the wix manifest file of the new release",
+				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
+				cli.StringFlag{
+					Name:  "old-path",
+					Usage: "Path to the wix manifest file of the previous release, checked instead of the msi files, required unless --no-check",
+				},
+				cli.StringFlag{
+					Name:  "old-base-dir",
+					Usage: "Directory of the relative paths of the previous wix manifest file, --base-dir by default",
+				},
+				cli.BoolFlag{
+					Name:  "no-check",
+					Usage: "Make the patch without --old-path, the component rules are then left to torch and pyro",
+				},
+				cli.StringFlag{
+					Name:  "src, s",
+					Usage: "Directory path to the templates overriding the embedded defaults, its patch sub directory is used",
+				},
+				cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Read the downloads of the templates from the cache instead of the network",
+				},
+				cli.StringFlag{
+					Name:  "out, o",
+					Value: tmpBuildDir,
+					Usage: "Directory path to the generated wix cmd file",
+				},
+				cli.StringFlag{
+					Name:  "old",
+					Usage: "Path to the msi file of the previous release",
+				},
+				cli.StringFlag{
+					Name:  "new",
+					Usage: "Path to the msi file of the new release",
+				},
+				cli.StringFlag{
+					Name:  "msp, m",
+					Usage: "Path to write resulting msp to",
+				},
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "The version of the new release",
+				},
+				cli.StringFlag{
+					Name:  "old-version",
+					Usage: "The version of the previous release",
+				},
+				cli.StringFlag{
+					Name:  "kind",
+					Value: "minor",
+					Usage: "The kind of patch, small (same version) or minor (greater version)",
+				},
+				cli.BoolFlag{
+					Name:  "keep, k",
+					Usage: "Keep output directory containing build files (useful for debug)",
+				},
 			},
 		},
 		{
@@ -279,10 +734,17 @@ func Main() {
 					Value: "wix.json",
 					Usage: "Path to the wix manifest file",
 				},
+				cli.StringFlag{
+					Name:  "base-dir",
+					Usage: "Directory of the relative paths of the wix manifest file, its own directory by default",
+				},
 				cli.StringFlag{
 					Name:  "src, s",
-					Value: filepath.Join(TPLPATH, "templates", "choco"),
-					Usage: "Directory path to the wix templates files",
+					Usage: "Directory path to the templates overriding the embedded defaults, its choco sub directory is used",
+				},
+				cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Read the downloads of the templates from the cache instead of the network",
 				},
 				cli.StringFlag{
 					Name:  "version",
@@ -318,6 +780,193 @@ func Main() {
 	}
 }
 
+func initManifest(c *cli.Context) error {
+	path := c.String("path")
+	dir := c.String("dir")
+	force := c.Bool("force")
+
+	if _, err := os.Stat(path); err == nil && !force {
+		return cli.NewExitError(fmt.Sprintf("%s already exists, use --force to overwrite it", path), 1)
+	}
+	m, err := scaffold.ReadModule(dir)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	p := newPrompter(c)
+
+	mains := c.StringSlice("main")
+	if len(mains) == 0 {
+		answer, err := p.String("", "Main packages to install", strings.Join(m.Mains, ","))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		mains = []string{}
+		for _, main := range strings.Split(answer, ",") {
+			if main = strings.TrimSpace(main); main != "" {
+				mains = append(mains, filepath.ToSlash(filepath.Clean(main)))
+			}
+		}
+	}
+	if len(mains) == 0 {
+		return cli.NewExitError(fmt.Sprintf("No main package found in %s, set --main", dir), 1)
+	}
+	for _, main := range mains {
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(main))); err != nil || !info.IsDir() {
+			return cli.NewExitError(fmt.Sprintf("Invalid main package %q, it is not a directory of %s", main, dir), 1)
+		}
+	}
+	s, err := scaffold.NewStarter(m, mains, path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if s.Product, err = p.String("product", "Product name", s.Product); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	company := s.Company
+	if company == "" {
+		company = s.Product
+	}
+	if s.Company, err = p.String("company", "Company name", company); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if s.Service, err = p.String("service", "Service name, - for none", ""); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if s.Shortcut, err = p.Bool("shortcut", "Add a start menu shortcut", true); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	license, err := p.String("license", "License file, - for none", scaffold.FindLicense(dir))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if license != "" {
+		isRtf, err := rtf.IsRtf(license)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		convert := false
+		if !isRtf {
+			if convert, err = p.Bool("license-rtf", "Convert the license to RTF", false); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+		}
+		if convert {
+			dst := strings.TrimSuffix(license, filepath.Ext(license)) + ".rtf"
+			if _, err := os.Stat(dst); err == nil && !force {
+				return cli.NewExitError(fmt.Sprintf("%s already exists, use --force to overwrite it", dst), 1)
+			}
+			if err := rtf.WriteAsRtf(license, dst, true); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			fmt.Println("The license is converted to", dst)
+			license = dst
+		}
+		if s.License, err = scaffold.Rel(path, license); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer f.Close()
+	if err := s.Write(f); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := f.Close(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println("The manifest is written to", path)
+	fmt.Println("Build the programs for windows then run:")
+	fmt.Printf("     go-msi make -p %s --msi %s.msi --version 0.0.1\n", path, s.Product)
+	return nil
+}
+
+// prompter asks for the values of the flags not set on the command line
+// when the standard input is a terminal, unless --yes is set.
+type prompter struct {
+	c           *cli.Context
+	in          *bufio.Reader
+	interactive bool
+}
+
+func newPrompter(c *cli.Context) *prompter {
+	interactive := false
+	if info, err := os.Stdin.Stat(); err == nil && !c.Bool("yes") {
+		interactive = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &prompter{c: c, in: bufio.NewReader(os.Stdin), interactive: interactive}
+}
+
+// String returns the value of flag if set, the answer to question
+// otherwise, proposal if empty and nothing if it is -.
+func (p *prompter) String(flag, question, proposal string) (string, error) {
+	if flag != "" && p.c.IsSet(flag) {
+		return p.c.String(flag), nil
+	}
+	if !p.interactive {
+		return proposal, nil
+	}
+	answer, err := p.ask(question, proposal)
+	if err != nil {
+		return "", err
+	}
+	switch answer {
+	case "":
+		return proposal, nil
+	case "-":
+		return "", nil
+	}
+	return answer, nil
+}
+
+// Bool returns the value of flag if set, the yes or no answer to
+// question otherwise.
+func (p *prompter) Bool(flag, question string, proposal bool) (bool, error) {
+	if p.c.IsSet(flag) {
+		return p.c.Bool(flag), nil
+	}
+	if !p.interactive {
+		return proposal, nil
+	}
+	choices := "y/N"
+	if proposal {
+		choices = "Y/n"
+	}
+	for p.interactive {
+		answer, err := p.ask(question, choices)
+		if err != nil || answer == "" {
+			return proposal, err
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+	return proposal, nil
+}
+
+func (p *prompter) ask(question, hint string) (string, error) {
+	fmt.Printf("%s [%s]: ", question, hint)
+	answer, err := p.in.ReadString('\n')
+	if err == io.EOF {
+		// no more answers, the proposals are used from now on
+		fmt.Println()
+		p.interactive = false
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
 var verReg = regexp.MustCompile(`\s[0-9]+[.][0-9]+[.][0-9]+`)
 
 func checkEnv(c *cli.Context) error {
@@ -344,6 +993,40 @@ func checkEnv(c *cli.Context) error {
 			}
 		}
 	}
+	if out, err := util.Exec("wix", "--version"); out == "" {
+		fmt.Printf("!!	%v not found: %q\n", "wix", err)
+	} else {
+		match := verReg.FindAllString(" "+out, -1)
+		if len(match) < 1 {
+			fmt.Printf("??	%v probably not found\n", "wix")
+		} else {
+			version := strings.TrimSpace(match[0])
+			ver, err := semver.NewVersion(version)
+			if err != nil {
+				fmt.Printf("??	%v found but its version is not parsable %v\n", "wix", version)
+			} else {
+				min := "4.0.0"
+				if ver.LessThan(semver.MustParse(min)) {
+					fmt.Printf("!!	%v found %v but >=%v is required\n", "wix", version, min)
+				} else {
+					fmt.Printf("ok	%v found %v\n", "wix", version)
+					exts, _ := util.Exec("wix", "extension", "list", "-g")
+					for _, ext := range wix.Wix4Extensions {
+						if strings.Contains(exts, ext) {
+							fmt.Printf("ok	%v found\n", ext)
+						} else {
+							fmt.Printf("!!	%v not found, run wix extension add -g %v\n", ext, ext)
+						}
+					}
+				}
+			}
+		}
+	}
+	if err := wix.Wix3.CheckReproducible(); err != nil {
+		fmt.Printf("!!	%v not found, make --reproducible requires it with the wix3 and wix4 toolsets\n", "MsiInfo")
+	} else {
+		fmt.Printf("ok	%v found\n", "MsiInfo")
+	}
 	if out, err := util.Exec("choco", "-v"); out == "" {
 		fmt.Printf("!!	%v not found: %q\n", "chocolatey", err)
 	} else {
@@ -382,7 +1065,7 @@ func addFiles(c *cli.Context) error {
 		return cli.NewExitError(fmt.Errorf("--includes argument is required"), 1)
 	}
 	wixFile := manifest.WixManifest{}
-	err := wixFile.Load(path)
+	err := wixFile.Read(path)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -394,51 +1077,137 @@ func addFiles(c *cli.Context) error {
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	added := []manifest.File{}
 	err = glob(dir, includes, func(match string) {
 		file := manifest.File{Path: filepath.ToSlash(filepath.Join(dir, match))}
 		if out[match] {
 			fmt.Println("    excluding", file.Path)
 			return
 		}
-		path := strings.Split(match, "/")
-		wixFile.Directory = addFile(wixFile.Directory, file, path)
+		dirs := strings.Split(match, "/")
+		if wixFile.AddFile(file, dirs[:len(dirs)-1]) {
+			added = append(added, file)
+		} else {
+			fmt.Println("    skipping", file.Path, "already listed")
+		}
 	}, true)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
 
-	if test {
-		return fmt.Errorf("file list not up to date")
+	return saveFiles(&wixFile, path, dir, added, nil, test)
+}
+
+func removeFiles(c *cli.Context) error {
+	path := c.String("path")
+	dir := c.String("dir")
+	includes := c.StringSlice("includes")
+	excludes := c.StringSlice("excludes")
+	test := c.Bool("test")
+
+	if len(includes) == 0 {
+		return cli.NewExitError(fmt.Errorf("--includes argument is required"), 1)
 	}
-	err = wixFile.Write(path)
+	wixFile := manifest.WixManifest{}
+	err := wixFile.Read(path)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
-	fmt.Println("The file is saved on disk")
-	return nil
+
+	removed := wixFile.RemoveFiles(func(file manifest.File) bool {
+		rel, ok := manifest.RelPath(dir, file.Path)
+		return ok && matchPatterns(includes, rel) && !matchPatterns(excludes, rel)
+	})
+	return saveFiles(&wixFile, path, dir, nil, removed, test)
 }
 
-func addFile(dir manifest.Directory, file manifest.File, path []string) manifest.Directory {
-	if len(path) == 1 {
-		for _, f := range dir.Files {
-			if f.Path == file.Path {
-				fmt.Println("    skipping", file.Path, "already listed")
-				return dir
-			}
+func syncFiles(c *cli.Context) error {
+	path := c.String("path")
+	dir := c.String("dir")
+	includes := c.StringSlice("includes")
+	excludes := c.StringSlice("excludes")
+	test := c.Bool("test")
+
+	if dir == "" {
+		return cli.NewExitError(fmt.Errorf("--dir argument is required"), 1)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return cli.NewExitError(fmt.Sprintf("--dir %q is not a directory", dir), 1)
+	}
+	if len(includes) == 0 {
+		includes = []string{"**"}
+	}
+	wixFile := manifest.WixManifest{}
+	err := wixFile.Read(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	found := []string{}
+	seen := map[string]bool{}
+	err = glob(dir, includes, func(match string) {
+		if !seen[match] && !matchPatterns(excludes, match) {
+			found = append(found, match)
+		}
+		seen[match] = true
+	}, false)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	sort.Strings(found)
+	added, removed := wixFile.SyncFiles(dir, found)
+	return saveFiles(&wixFile, path, dir, added, removed, test)
+}
+
+// saveFiles reports the files added to and removed from the manifest,
+// then writes it. In test mode it prints the changes as a diff instead
+// and exits with an error if there are any.
+func saveFiles(wixFile *manifest.WixManifest, path, dir string, added, removed []manifest.File, test bool) error {
+	if test {
+		if len(added) == 0 && len(removed) == 0 {
+			fmt.Println("The file list is up to date")
+			return nil
+		}
+		fmt.Println("---", path)
+		fmt.Println("+++", dir)
+		for _, file := range removed {
+			fmt.Println("-" + file.Path)
 		}
+		for _, file := range added {
+			fmt.Println("+" + file.Path)
+		}
+		return cli.NewExitError("file list not up to date", 1)
+	}
+
+	for _, file := range removed {
+		fmt.Println("    removing", file.Path)
+	}
+	for _, file := range added {
 		fmt.Println("    adding", file.Path)
-		dir.Files = append(dir.Files, file)
-		return dir
 	}
-	for i, d := range dir.Directories {
-		if d.Name == path[0] {
-			dir.Directories[i] = addFile(d, file, path[1:])
-			return dir
+	if len(added) == 0 && len(removed) == 0 {
+		fmt.Println("The file list is up to date")
+		return nil
+	}
+	if err := wixFile.Write(path); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println("The file is saved on disk")
+	return nil
+}
+
+// matchPatterns tells whether the slash separated path matches one of
+// the comma separated lists of patterns.
+func matchPatterns(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		for _, one := range strings.Split(pattern, ",") {
+			if ok, _ := doublestar.Match(one, p); ok {
+				return true
+			}
 		}
 	}
-	d := addFile(manifest.Directory{Name: path[0]}, file, path[1:])
-	dir.Directories = append(dir.Directories, d)
-	return dir
+	return false
 }
 
 func glob(dir string, patterns []string, f func(match string), fail bool) error {
@@ -477,7 +1246,7 @@ func setGUID(c *cli.Context) error {
 	force := c.Bool("force")
 
 	wixFile := manifest.WixManifest{}
-	err := wixFile.Load(path)
+	err := wixFile.Read(path)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -510,12 +1279,33 @@ func generateTemplates(c *cli.Context) error {
 	display := c.String("display")
 	license := c.String("license")
 	properties := c.StringSlice("property")
+	kind := c.String("kind")
 
-	wixFile := manifest.WixManifest{}
+	if c.Bool("eject") {
+		if !c.IsSet("out") {
+			return cli.NewExitError("--out parameter must be set with --eject", 1)
+		}
+		written, err := templates.Eject(out)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Printf("Ejected %d default templates\n", len(written))
+		for _, f := range written {
+			fmt.Printf("- %s\n", f)
+		}
+		return nil
+	}
+
+	wixFile := manifest.WixManifest{BaseDir: c.String("base-dir")}
 	err := wixFile.Load(path)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
+	if c.Bool("debug-manifest") {
+		if err := wixFile.WriteDebug(path); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
 
 	if wixFile.NeedGUID() {
 		fmt.Println("The manifest needs Guid")
@@ -525,6 +1315,7 @@ func generateTemplates(c *cli.Context) error {
 	}
 
 	wixFile.Compression = compression
+	wixFile.Kind = kind
 	wixFile.Version.User = version
 	wixFile.Version.Display = display
 
@@ -532,7 +1323,7 @@ func generateTemplates(c *cli.Context) error {
 		wixFile.License = license
 	}
 
-	if err := addProperties(&wixFile, properties); err != nil {
+	if err := builder.AddProperties(&wixFile, properties); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
@@ -540,11 +1331,27 @@ func generateTemplates(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
+	toolset, err := wix.SelectToolset(c.String("toolset"), "")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := toolset.Check(&wixFile); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if _, err := builder.LockFiles(&wixFile, path, os.Stdout, c.Bool("update-lock")); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
 	if err := wixFile.RewriteFilePaths(out); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	tpls, err := templates.Find(src, "*.wxs")
+	fsys, err := templates.Overlay(src, "")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	tpls, err := templates.Find(fsys, builder.TemplatesDir(kind, toolset), "*.wxs")
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -559,17 +1366,25 @@ func generateTemplates(c *cli.Context) error {
 
 	for _, tpl := range tpls {
 		dst := filepath.Join(out, filepath.Base(tpl))
-		err = templates.GenerateTemplate(&wixFile, tpl, dst)
+		err = templates.GenerateTemplate(&wixFile, fsys, tpl, dst, templateOptions(c))
 		if err != nil {
 			return cli.NewExitError(err.Error(), 1)
 		}
 	}
 
+	locs, err := wix.GenerateLocalizations(&wixFile, out)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
 	fmt.Printf("Generated %d templates\n", len(tpls))
 	for _, tpl := range tpls {
 		dst := filepath.Join(out, filepath.Base(tpl))
 		fmt.Printf("- %s\n", dst)
 	}
+	for _, loc := range locs {
+		fmt.Printf("- %s\n", loc)
+	}
 
 	return nil
 }
@@ -627,12 +1442,30 @@ func generateWixCommands(c *cli.Context) error {
 	msi := c.String("msi")
 	arch := c.String("arch")
 	bin := c.String("bin")
+	kind := c.String("kind")
+	format := c.String("format")
 
 	if msi == "" {
 		return cli.NewExitError("--msi parameter must be set", 1)
 	}
 
-	templates, err := templates.Find(src, "*.wxs")
+	var err error
+	if bin != "" {
+		if bin, err = filepath.Abs(bin); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	toolset, err := wix.SelectToolset(c.String("toolset"), bin)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fsys, err := templates.Overlay(src, "")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	templates, err := templates.Find(fsys, builder.TemplatesDir(kind, toolset), "*.wxs")
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -645,7 +1478,7 @@ func generateWixCommands(c *cli.Context) error {
 		builtTemplates[i] = filepath.Join(out, filepath.Base(tpl))
 	}
 
-	wixFile := manifest.WixManifest{}
+	wixFile := manifest.WixManifest{BaseDir: c.String("base-dir")}
 	err = wixFile.Load(path)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
@@ -658,10 +1491,16 @@ func generateWixCommands(c *cli.Context) error {
 		return cli.NewExitError("Cannot proceed, manifest file is incomplete", 1)
 	}
 
+	wixFile.Kind = kind
+
 	if err := wixFile.Normalize(); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
+	if err := toolset.Check(&wixFile); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
 	if err := wixFile.RewriteFilePaths(out); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -675,16 +1514,23 @@ func generateWixCommands(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	if bin != "" {
-		if bin, err = filepath.Abs(bin); err != nil {
-			return cli.NewExitError(err.Error(), 1)
-		}
-	}
+	cmds := toolset.GenerateCmd(&wixFile, builtTemplates, msi, arch, bin)
 
-	cmdStr := wix.GenerateCmd(&wixFile, builtTemplates, msi, arch, bin)
+	script, err := wix.Script(cmds, format)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	targetFile := filepath.Join(out, "build."+format)
+	err = ioutil.WriteFile(targetFile, []byte(script), 0755)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 
-	targetFile := filepath.Join(out, "build.bat")
-	err = ioutil.WriteFile(targetFile, []byte(cmdStr), 0644)
+	dat, err := json.MarshalIndent(cmds, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	err = ioutil.WriteFile(filepath.Join(out, "build.json"), dat, 0644)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -695,40 +1541,180 @@ func generateWixCommands(c *cli.Context) error {
 func runWixCommands(c *cli.Context) error {
 	out := c.String("out")
 
-	oCmd := exec.Command("cmd.exe", "/C", "build.bat")
-	oCmd.Dir = out
-	oCmd.Stdout = os.Stdout
-	oCmd.Stderr = os.Stderr
-	err := oCmd.Run()
+	dat, err := ioutil.ReadFile(filepath.Join(out, "build.json"))
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
+	var cmds []wix.Command
+	if err := json.Unmarshal(dat, &cmds); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if err := wix.Run(context.Background(), cmds, out, os.Stdout); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 
 	return nil
 }
 
+// templateOptions returns the options of the template functions, the
+// downloads are cached in the default cache directory.
+func templateOptions(c *cli.Context) templates.Options {
+	return templates.Options{CacheDir: builder.DefaultCacheDir(), Offline: c.Bool("offline")}
+}
+
 func quickMake(c *cli.Context) error {
+	opts := builder.Options{
+		Path:          c.String("path"),
+		Src:           c.String("src"),
+		Out:           c.String("out"),
+		Msi:           c.String("msi"),
+		Version:       c.String("version"),
+		Display:       c.String("display"),
+		Compression:   c.String("compression"),
+		Properties:    c.StringSlice("property"),
+		Arch:          c.String("arch"),
+		Kind:          c.String("kind"),
+		Toolset:       c.String("toolset"),
+		Bin:           c.String("bin"),
+		Keep:          c.Bool("keep"),
+		Reproducible:  c.Bool("reproducible"),
+		UpdateLock:    c.Bool("update-lock"),
+		Sbom:          c.String("sbom"),
+		SbomFormat:    c.String("sbom-format"),
+		Report:        c.String("report"),
+		Offline:       c.Bool("offline"),
+		BaseDir:       c.String("base-dir"),
+		DebugManifest: c.Bool("debug-manifest"),
+		Output:        os.Stdout,
+	}
+	if !c.Bool("no-cache") {
+		opts.CacheDir = c.String("cache-dir")
+	}
+	if c.IsSet("license") {
+		opts.License = c.String("license")
+	}
+
+	b := builder.New(opts)
+	if err := b.Build(context.Background()); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if opts.Keep {
+		fmt.Printf("Build files are available in %s\n", b.Out())
+	}
+
+	fmt.Println("All Done!!")
+
+	return nil
+}
+
+func render(c *cli.Context) error {
+	out := c.String("out")
+	opts := builder.Options{
+		Path:          c.String("path"),
+		Src:           c.String("src"),
+		Out:           out,
+		Msi:           c.String("msi"),
+		Version:       c.String("version"),
+		Display:       c.String("display"),
+		Properties:    c.StringSlice("property"),
+		Arch:          c.String("arch"),
+		Kind:          c.String("kind"),
+		Toolset:       c.String("toolset"),
+		DryRun:        true,
+		UpdateLock:    c.Bool("update-lock"),
+		Pretty:        c.Bool("pretty"),
+		Validate:      c.Bool("validate"),
+		CacheDir:      builder.DefaultCacheDir(),
+		Offline:       c.Bool("offline"),
+		BaseDir:       c.String("base-dir"),
+		DebugManifest: c.Bool("debug-manifest"),
+		Output:        os.Stderr,
+	}
+	if c.IsSet("license") {
+		opts.License = c.String("license")
+	}
+
+	b := builder.New(opts)
+	if err := b.Build(context.Background()); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if out == "" {
+		defer os.RemoveAll(b.Out())
+		for _, f := range b.Files() {
+			byt, err := ioutil.ReadFile(f)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			fmt.Printf("==> %s <==\n%s\n", filepath.Base(f), byt)
+		}
+		fmt.Println("==> commands <==")
+	}
+	for _, cmd := range b.Commands() {
+		fmt.Println(cmd)
+	}
+
+	return nil
+}
+
+func writeSbom(c *cli.Context) error {
+	path := c.String("path")
+	version := c.String("version")
+	format := c.String("format")
+	out := c.String("out")
+
+	wixFile := manifest.WixManifest{BaseDir: c.String("base-dir")}
+	if err := wixFile.Load(path); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	wixFile.Version.User = version
+	if err := wixFile.Normalize(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	s, err := sbom.New(&wixFile, time.Now())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := s.WriteFile(out, format); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("The software bill of materials is written to %s\n", out)
+
+	return nil
+}
+
+func bundleMake(c *cli.Context) error {
 	path := c.String("path")
 	src := c.String("src")
 	out := c.String("out")
-	compression := c.String("compression")
 	version := c.String("version")
-	display := c.String("display")
 	license := c.String("license")
-	properties := c.StringSlice("property")
 	msi := c.String("msi")
+	exe := c.String("exe")
 	arch := c.String("arch")
 	keep := c.Bool("keep")
 	bin := c.String("bin")
 
-	if msi == "" {
-		return cli.NewExitError("--msi parameter must be set", 1)
+	if exe == "" {
+		return cli.NewExitError("--exe parameter must be set", 1)
 	}
 
-	wixFile := manifest.WixManifest{}
+	wixFile := manifest.WixManifest{BaseDir: c.String("base-dir")}
 	if err := wixFile.Load(path); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
+	if wixFile.Bundle == nil {
+		return cli.NewExitError("The manifest has no bundle section", 1)
+	}
+	if msi != "" {
+		if err := wixFile.Bundle.ChainMsi(msi); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if len(wixFile.Bundle.Packages) == 0 {
+		return cli.NewExitError("The bundle has no package to chain", 1)
+	}
 
 	if _, err := wixFile.SetGuids(false); err != nil {
 		return cli.NewExitError(err.Error(), 1)
@@ -741,29 +1727,12 @@ func quickMake(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	wixFile.Compression = compression
 	wixFile.Version.User = version
-	wixFile.Version.Display = display
 
 	if c.IsSet("license") {
 		wixFile.License = license
 	}
-	if wixFile.License != "" {
-		isRtf, err := rtf.IsRtf(wixFile.License)
-		if err != nil {
-			return cli.NewExitError(err.Error(), 1)
-		}
-		if !isRtf {
-			fmt.Println("Converting license to RTF")
-			target := filepath.Join(out, filepath.Base(wixFile.License)+".rtf")
-			if err := rtf.WriteAsRtf(wixFile.License, target, true); err != nil {
-				return cli.NewExitError(err.Error(), 1)
-			}
-			wixFile.License = target
-		}
-	}
-
-	if err := addProperties(&wixFile, properties); err != nil {
+	if err := builder.ConvertLicense(&wixFile, out, os.Stdout); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
@@ -775,7 +1744,11 @@ func quickMake(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	tpls, err := templates.Find(src, "*.wxs")
+	fsys, err := templates.Overlay(src, "bundle")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	tpls, err := templates.Find(fsys, ".", "*.wxs")
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -786,18 +1759,18 @@ func quickMake(c *cli.Context) error {
 	builtTemplates := make([]string, len(tpls))
 	for i, tpl := range tpls {
 		dst := filepath.Join(out, filepath.Base(tpl))
-		err = templates.GenerateTemplate(&wixFile, tpl, dst)
+		err = templates.GenerateTemplate(&wixFile, fsys, tpl, dst, templateOptions(c))
 		builtTemplates[i] = dst
 		if err != nil {
 			return cli.NewExitError(err.Error(), 1)
 		}
 	}
 
-	msi, err = filepath.Abs(msi)
+	exe, err = filepath.Abs(exe)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
-	msi, err = filepath.Rel(out, msi)
+	exe, err = filepath.Rel(out, exe)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -808,23 +1781,20 @@ func quickMake(c *cli.Context) error {
 		}
 	}
 
-	cmdStr := wix.GenerateCmd(&wixFile, builtTemplates, msi, arch, bin)
-
-	targetFile := filepath.Join(out, "build.bat")
-	err = ioutil.WriteFile(targetFile, []byte(cmdStr), 0644)
+	toolset, err := wix.SelectToolset(c.String("toolset"), bin)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	oCmd := exec.Command("cmd.exe", "/C", "build.bat")
-	oCmd.Dir = out
-	oCmd.Stdout = os.Stdout
-	oCmd.Stderr = os.Stderr
-	err = oCmd.Run()
+	cmds, err := toolset.GenerateBundleCmd(&wixFile, builtTemplates, exe, arch, bin)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
+	if err := wix.Run(context.Background(), cmds, out, os.Stdout); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
 	if keep == false {
 		err = os.RemoveAll(out)
 		if err != nil {
@@ -839,20 +1809,136 @@ func quickMake(c *cli.Context) error {
 	return nil
 }
 
-func addProperties(wixFile *manifest.WixManifest, properties []string) error {
-	for _, prop := range properties {
-		s := strings.SplitN(prop, "=", 2)
-		if len(s) < 2 {
-			return fmt.Errorf("property definition must be of the form Id=Value")
-		}
-		v := manifest.Value(s[1])
-		wixFile.Properties = append(wixFile.Properties,
-			manifest.Property{
-				ID:    s[0],
-				Value: &v,
-			},
-		)
+func patchMake(c *cli.Context) error {
+	path := c.String("path")
+	oldPath := c.String("old-path")
+	src := c.String("src")
+	out := c.String("out")
+	oldMsi := c.String("old")
+	newMsi := c.String("new")
+	msp := c.String("msp")
+	kind := c.String("kind")
+	keep := c.Bool("keep")
+	bin := c.String("bin")
+
+	for _, flag := range []string{"old", "new", "msp", "version"} {
+		if c.String(flag) == "" {
+			return cli.NewExitError(fmt.Sprintf("--%s parameter must be set", flag), 1)
+		}
+	}
+
+	wixFile := manifest.WixManifest{BaseDir: c.String("base-dir")}
+	if err := wixFile.Load(path); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	wixFile.Version.User = c.String("version")
+
+	if oldPath == "" && !c.Bool("no-check") {
+		return cli.NewExitError("--old-path parameter must be set to check the component rules, or --no-check to leave them to torch and pyro", 1)
+	}
+	if oldPath != "" {
+		if c.String("old-version") == "" {
+			return cli.NewExitError("--old-version parameter must be set", 1)
+		}
+		oldBaseDir := c.String("old-base-dir")
+		if oldBaseDir == "" {
+			oldBaseDir = c.String("base-dir")
+		}
+		oldFile := manifest.WixManifest{BaseDir: oldBaseDir}
+		if err := oldFile.Load(oldPath); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		oldFile.Version.User = c.String("old-version")
+
+		oldLock, err := manifest.LoadLock(builder.LockPath(oldPath))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		newLock, err := manifest.LoadLock(builder.LockPath(path))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if err := manifest.CheckPatch(&oldFile, &wixFile, oldLock, newLock, kind); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		fmt.Println("Warning: --no-check given, the component rules are left to torch and pyro")
+	}
+
+	if err := wixFile.NormalizePatch(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if err := os.RemoveAll(out); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := os.MkdirAll(out, 0744); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fsys, err := templates.Overlay(src, "patch")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	tpls, err := templates.Find(fsys, ".", "*.wxs")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if len(tpls) == 0 {
+		return cli.NewExitError("No templates *.wxs found in this directory", 1)
+	}
+
+	builtTemplates := make([]string, len(tpls))
+	for i, tpl := range tpls {
+		dst := filepath.Join(out, filepath.Base(tpl))
+		err = templates.GenerateTemplate(&wixFile, fsys, tpl, dst, templateOptions(c))
+		builtTemplates[i] = dst
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	paths := []*string{&oldMsi, &newMsi, &msp}
+	for _, p := range paths {
+		if *p, err = filepath.Abs(*p); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if *p, err = filepath.Rel(out, *p); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	if bin != "" {
+		if bin, err = filepath.Abs(bin); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	toolset, err := wix.SelectToolset(c.String("toolset"), bin)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	cmds, err := toolset.GeneratePatchCmd(&wixFile, builtTemplates, oldMsi, newMsi, msp, bin)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if err := wix.Run(context.Background(), cmds, out, os.Stdout); err != nil {
+		return cli.NewExitError(err.Error(), 1)
 	}
+
+	if keep == false {
+		err = os.RemoveAll(out)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		fmt.Printf("Build files are available in %s\n", out)
+	}
+
+	fmt.Println("All Done!!")
+
 	return nil
 }
 
@@ -866,7 +1952,7 @@ func chocoMake(c *cli.Context) error {
 	changelogCmd := c.String("changelog-cmd")
 	keep := c.Bool("keep")
 
-	wixFile := manifest.WixManifest{}
+	wixFile := manifest.WixManifest{BaseDir: c.String("base-dir")}
 	if err := wixFile.Load(path); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -885,7 +1971,11 @@ func chocoMake(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	tpls, err := templates.Find(src, "*")
+	fsys, err := templates.Overlay(src, "choco")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	tpls, err := templates.Find(fsys, ".", "*")
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -930,7 +2020,7 @@ func chocoMake(c *cli.Context) error {
 
 	for _, tpl := range tpls {
 		dst := filepath.Join(out, filepath.Base(tpl))
-		err := templates.GenerateTemplate(&wixFile, tpl, dst)
+		err := templates.GenerateTemplate(&wixFile, fsys, tpl, dst, templateOptions(c))
 		if err != nil {
 			return cli.NewExitError(err.Error(), 1)
 		}
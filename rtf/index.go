@@ -69,10 +69,19 @@ func WriteAsRtf(src string, dst string, reencode bool) error {
 		bDst = bSrc
 	}
 
-	sDat := strings.NewReplacer("\n", "\n\\line ").Replace(string(bDst))
-	sDat = "{\\rtf1\\ansi\r\n" + sDat + "\r\n}"
+	return ioutil.WriteFile(dst, []byte(format(string(bDst))), 0644)
+}
+
+// ToRtf formats the given text as an RTF document, escaping the RTF
+// control characters.
+func ToRtf(text string) string {
+	text = strings.NewReplacer("\r\n", "\n", `\`, `\\`, "{", `\{`, "}", `\}`).Replace(text)
+	return format(text)
+}
 
-	return ioutil.WriteFile(dst, []byte(sDat), 0644)
+func format(text string) string {
+	text = strings.NewReplacer("\n", "\n\\line ").Replace(text)
+	return "{\\rtf1\\ansi\r\n" + text + "\r\n}"
 }
 
 // IsRtf Detects if the given src file is formatted with RTF format.
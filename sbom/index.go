@@ -0,0 +1,400 @@
+// Package sbom lists the files installed by a package and the Go modules
+// built into them as a CycloneDX or SPDX software bill of materials.
+package sbom
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/observiq/go-msi/manifest"
+)
+
+// Formats lists the supported formats.
+var Formats = []string{"cyclonedx", "spdx"}
+
+// SBOM is the software bill of materials of a package.
+type SBOM struct {
+	Product string
+	Company string
+	Version string
+	Created time.Time
+	Files   []File
+}
+
+// File is a file installed by the package.
+type File struct {
+	InstallPath string // relative to the install directory
+	Sha1        string
+	Sha256      string
+	GoVersion   string   // of the toolchain, when the file is a Go binary
+	Modules     []Module // main module first, when the file is a Go binary
+}
+
+// Module is a Go module built into a binary.
+type Module struct {
+	Path    string
+	Version string
+}
+
+// Purl returns the package URL of the module.
+func (m Module) Purl() string {
+	if m.Version == "" || m.Version == "(devel)" {
+		return "pkg:golang/" + m.Path
+	}
+	return "pkg:golang/" + m.Path + "@" + m.Version
+}
+
+// New reads the files of the manifest, created is the date of the document.
+func New(wixFile *manifest.WixManifest, created time.Time) (*SBOM, error) {
+	if err := wixFile.AssignIDs(); err != nil {
+		return nil, err
+	}
+	s := &SBOM{
+		Product: wixFile.Product,
+		Company: wixFile.Company,
+		Version: wixFile.Version.User,
+		Created: created.UTC(),
+	}
+	for _, f := range wixFile.AllFiles() {
+		file, err := readFile(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		file.InstallPath = f.InstallPath
+		s.Files = append(s.Files, file)
+	}
+	sort.Slice(s.Files, func(i, j int) bool {
+		return s.Files[i].InstallPath < s.Files[j].InstallPath
+	})
+	return s, nil
+}
+
+func readFile(p string) (File, error) {
+	var file File
+	f, err := os.Open(p)
+	if err != nil {
+		return file, err
+	}
+	defer f.Close()
+	h1, h256 := sha1.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h1, h256), f); err != nil {
+		return file, err
+	}
+	file.Sha1 = hex.EncodeToString(h1.Sum(nil))
+	file.Sha256 = hex.EncodeToString(h256.Sum(nil))
+
+	// files other than Go binaries have no build info
+	info, err := buildinfo.Read(f)
+	if err != nil {
+		return file, nil
+	}
+	file.GoVersion = info.GoVersion
+	file.Modules = modules(info)
+	return file, nil
+}
+
+// modules lists the modules of the build info, the main module has no
+// path when built outside of a module.
+func modules(info *debug.BuildInfo) []Module {
+	var mods []Module
+	for _, mod := range append([]*debug.Module{&info.Main}, info.Deps...) {
+		if mod.Replace != nil {
+			mod = mod.Replace
+		}
+		if mod.Path != "" {
+			mods = append(mods, Module{mod.Path, mod.Version})
+		}
+	}
+	return mods
+}
+
+// CheckFormat tells if the format is supported.
+func CheckFormat(format string) error {
+	for _, f := range Formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid sbom format %q, must be one of %s", format, strings.Join(Formats, ", "))
+}
+
+// Write writes the document in the given format, cyclonedx or spdx.
+func (s *SBOM) Write(w io.Writer, format string) error {
+	if err := CheckFormat(format); err != nil {
+		return err
+	}
+	var doc interface{} = s.cycloneDX()
+	if format == "spdx" {
+		doc = s.spdx()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// WriteFile writes the document in the given format to the p file.
+func (s *SBOM) WriteFile(p, format string) error {
+	if err := CheckFormat(format); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// id identifies the document from its content, rebuilding a package
+// gives the same document.
+func (s *SBOM) id() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", s.Product, s.Company, s.Version)
+	for _, f := range s.Files {
+		fmt.Fprintf(h, "%s %s\n", f.InstallPath, f.Sha256)
+	}
+	return uuid.NewSHA1(uuid.NameSpaceURL, h.Sum(nil)).String()
+}
+
+// modules returns the modules of all files, once each.
+func (s *SBOM) modules() []Module {
+	seen := make(map[Module]bool)
+	var modules []Module
+	for _, f := range s.Files {
+		for _, m := range f.Modules {
+			if !seen[m] {
+				seen[m] = true
+				modules = append(modules, m)
+			}
+		}
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].Purl() < modules[j].Purl()
+	})
+	return modules
+}
+
+type cdxDocument struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	Supplier   *cdxSupplier  `json:"supplier,omitempty"`
+	Purl       string        `json:"purl,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxSupplier struct {
+	Name string `json:"name"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func (s *SBOM) cycloneDX() cdxDocument {
+	doc := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + s.id(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: s.Created.Format(time.RFC3339),
+			Tools:     []cdxTool{{Name: "go-msi"}},
+			Component: cdxComponent{
+				Type:     "application",
+				BOMRef:   "product",
+				Name:     s.Product,
+				Version:  s.Version,
+				Supplier: &cdxSupplier{Name: s.Company},
+			},
+		},
+		Components:   []cdxComponent{},
+		Dependencies: []cdxDependency{},
+	}
+	product := cdxDependency{Ref: "product", DependsOn: []string{}}
+	for _, f := range s.Files {
+		ref := "file:" + f.InstallPath
+		product.DependsOn = append(product.DependsOn, ref)
+		c := cdxComponent{
+			Type:   "file",
+			BOMRef: ref,
+			Name:   f.InstallPath,
+			Hashes: []cdxHash{{"SHA-1", f.Sha1}, {"SHA-256", f.Sha256}},
+			Properties: []cdxProperty{
+				{"go-msi:install-path", f.InstallPath},
+			},
+		}
+		if f.GoVersion != "" {
+			c.Properties = append(c.Properties, cdxProperty{"go-msi:go-version", f.GoVersion})
+			dep := cdxDependency{Ref: ref, DependsOn: []string{}}
+			for _, m := range f.Modules {
+				dep.DependsOn = append(dep.DependsOn, m.Purl())
+			}
+			doc.Dependencies = append(doc.Dependencies, dep)
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	for _, m := range s.modules() {
+		doc.Components = append(doc.Components, cdxComponent{
+			Type:    "library",
+			BOMRef:  m.Purl(),
+			Name:    m.Path,
+			Version: m.Version,
+			Purl:    m.Purl(),
+		})
+	}
+	doc.Dependencies = append([]cdxDependency{product}, doc.Dependencies...)
+	return doc
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	Supplier         string            `json:"supplier,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxFile struct {
+	FileName  string         `json:"fileName"`
+	SPDXID    string         `json:"SPDXID"`
+	Checksums []spdxChecksum `json:"checksums"`
+	Comment   string         `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+func (s *SBOM) spdx() spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              strings.TrimSpace(s.Product + " " + s.Version),
+		DocumentNamespace: "https://spdx.org/spdxdocs/go-msi/" + s.id(),
+		CreationInfo: spdxCreationInfo{
+			Created:  s.Created.Format(time.RFC3339),
+			Creators: []string{"Tool: go-msi"},
+		},
+		Packages: []spdxPackage{{
+			Name:             s.Product,
+			SPDXID:           "SPDXRef-Package",
+			VersionInfo:      s.Version,
+			Supplier:         "Organization: " + s.Company,
+			DownloadLocation: "NOASSERTION",
+		}},
+		Files: []spdxFile{},
+		Relationships: []spdxRelationship{
+			{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Package"},
+		},
+	}
+	ids := make(map[Module]string)
+	for i, m := range s.modules() {
+		id := fmt.Sprintf("SPDXRef-Module-%d", i+1)
+		ids[m] = id
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             m.Path,
+			SPDXID:           id,
+			VersionInfo:      m.Version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs:     []spdxExternalRef{{"PACKAGE-MANAGER", "purl", m.Purl()}},
+		})
+	}
+	for i, f := range s.Files {
+		id := fmt.Sprintf("SPDXRef-File-%d", i+1)
+		file := spdxFile{
+			FileName:  "./" + f.InstallPath,
+			SPDXID:    id,
+			Checksums: []spdxChecksum{{"SHA1", f.Sha1}, {"SHA256", f.Sha256}},
+		}
+		if f.GoVersion != "" {
+			file.Comment = "Built with " + f.GoVersion
+		}
+		doc.Files = append(doc.Files, file)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Package", "CONTAINS", id})
+		for _, m := range f.Modules {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{id, "DEPENDS_ON", ids[m]})
+		}
+	}
+	return doc
+}
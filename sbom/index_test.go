@@ -0,0 +1,55 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSBOM(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	wixFile := &manifest.WixManifest{Product: "hello", Company: "acme"}
+	wixFile.Version.User = "1.0.0"
+	wixFile.Directories = []manifest.Directory{{
+		Name:  "bin",
+		Files: []manifest.File{{Path: exe}, {Path: filepath.Join("..", "LICENSE")}},
+	}}
+
+	s, err := New(wixFile, time.Unix(0, 0))
+	require.NoError(t, err)
+	require.Len(t, s.Files, 2)
+	require.Equal(t, "bin/"+filepath.Base(exe), s.Files[1].InstallPath)
+	require.Empty(t, s.Files[0].Modules)
+	require.Contains(t, s.Files[1].Modules, Module{"github.com/stretchr/testify", "v1.7.0"})
+
+	var cdx, spdx bytes.Buffer
+	require.NoError(t, s.Write(&cdx, "cyclonedx"))
+	require.NoError(t, s.Write(&spdx, "spdx"))
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(cdx.Bytes(), &doc))
+	require.Equal(t, "CycloneDX", doc["bomFormat"])
+	require.NoError(t, json.Unmarshal(spdx.Bytes(), &doc))
+	require.Equal(t, "SPDX-2.3", doc["spdxVersion"])
+	require.Contains(t, spdx.String(), `"referenceLocator": "pkg:golang/github.com/stretchr/testify@v1.7.0"`)
+
+	require.EqualError(t, s.Write(&cdx, "xml"), `invalid sbom format "xml", must be one of cyclonedx, spdx`)
+}
+
+func TestModules(t *testing.T) {
+	info := &debug.BuildInfo{Deps: []*debug.Module{
+		{Path: "github.com/google/uuid", Version: "v1.3.0"},
+		{Path: "example.com/old", Version: "v1.0.0", Replace: &debug.Module{Path: "example.com/new", Version: "v1.1.0"}},
+	}}
+	require.Equal(t, []Module{{"github.com/google/uuid", "v1.3.0"}, {"example.com/new", "v1.1.0"}}, modules(info))
+
+	info.Main = debug.Module{Path: "example.com/hello", Version: "(devel)"}
+	require.Equal(t, Module{"example.com/hello", "(devel)"}, modules(info)[0])
+}
@@ -0,0 +1,262 @@
+// Package scaffold writes a starter wix.json manifest for a Go module,
+// it is the library behind the init command.
+package scaffold
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/observiq/go-msi/manifest"
+)
+
+// Module is a Go module along with its main packages.
+type Module struct {
+	Path  string   // module path declared by go.mod
+	Dir   string   // directory of go.mod
+	Mains []string // slash separated directories of the main packages, relative to Dir
+}
+
+var modulePath = regexp.MustCompile(`(?m)^\s*module\s+"?([^"\s]+)"?`)
+
+// ReadModule reads the go.mod file of dir and finds the main packages
+// built for windows in it, the nested modules, vendor and testdata
+// directories excepted.
+func ReadModule(dir string) (*Module, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	match := modulePath.FindSubmatch(dat)
+	if match == nil {
+		return nil, fmt.Errorf("no module path in %s", filepath.Join(dir, "go.mod"))
+	}
+	m := &Module{Path: string(match[1]), Dir: dir, Mains: []string{}}
+
+	ctx := build.Default
+	ctx.GOOS = "windows"
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if p != dir {
+			if name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		pkg, err := ctx.ImportDir(p, 0)
+		if err != nil || !pkg.IsCommand() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		m.Mains = append(m.Mains, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// Name returns the last element of the module path, the major version
+// excepted.
+func (m *Module) Name() string {
+	elems := strings.Split(m.Path, "/")
+	if len(elems) > 1 && majorVersion.MatchString(elems[len(elems)-1]) {
+		elems = elems[:len(elems)-1]
+	}
+	return elems[len(elems)-1]
+}
+
+// Owner returns the owner of a module hosted like github.com/owner/name,
+// empty otherwise.
+func (m *Module) Owner() string {
+	elems := strings.Split(m.Path, "/")
+	if len(elems) < 3 || !strings.Contains(elems[0], ".") {
+		return ""
+	}
+	return elems[1]
+}
+
+// Command returns the name of the executable of the main package dir.
+func (m *Module) Command(dir string) string {
+	if dir == "." {
+		return m.Name()
+	}
+	return path.Base(dir)
+}
+
+// FindLicense returns the path of the license file of dir, empty if there
+// is none.
+func FindLicense(dir string) string {
+	for _, name := range []string{"LICENSE", "LICENSE.txt", "LICENSE.md", "LICENSE.rtf", "COPYING"} {
+		p := filepath.Join(dir, name)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+// Executable is a program installed by the starter manifest.
+type Executable struct {
+	Name    string // file name of the program
+	Package string // main package, like ./cmd/hello
+	Output  string // path of the program built from the module directory
+	Path    string // path of the program relative to the manifest
+}
+
+// Starter is the content of a starter manifest.
+type Starter struct {
+	Product     string
+	Company     string
+	UpgradeCode string
+	License     string // relative to the manifest, none if empty
+	Executables []Executable
+	Service     string // name of the service, none if empty
+	Shortcut    bool   // start menu shortcut to the first executable
+}
+
+// NewStarter proposes a starter manifest written to the manifest file p
+// for the main packages mains of m, built to the build directory of m,
+// along with a fresh upgrade code.
+func NewStarter(m *Module, mains []string, p string) (*Starter, error) {
+	wixFile := manifest.WixManifest{}
+	if _, err := wixFile.SetGuids(false); err != nil {
+		return nil, err
+	}
+	s := &Starter{
+		Product:     m.Name(),
+		Company:     m.Owner(),
+		UpgradeCode: wixFile.UpgradeCode,
+		Executables: []Executable{},
+		Shortcut:    true,
+	}
+	for _, main := range mains {
+		name := m.Command(main) + ".exe"
+		output := path.Join("build", name)
+		rel, err := Rel(p, filepath.Join(m.Dir, filepath.FromSlash(output)))
+		if err != nil {
+			return nil, err
+		}
+		pkg := "./" + main
+		if main == "." {
+			pkg = "."
+		}
+		s.Executables = append(s.Executables, Executable{
+			Name:    name,
+			Package: pkg,
+			Output:  output,
+			Path:    rel,
+		})
+	}
+	return s, nil
+}
+
+// Rel returns the slash separated path of target relative to the
+// directory of the manifest file p.
+func Rel(p, target string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// The "//" members are the comments of the manifest, they are ignored
+// when it is loaded.
+var starter = template.Must(template.New("wix.json").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}).Parse(`{
+  "//": "Starter manifest written by go-msi init, make the package with: go-msi make --msi {{.Product}}.msi --version 0.0.1",
+  "//": "The members named // are comments, they are ignored and dropped when go-msi writes the manifest back.",
+  "product": {{json .Product}},
+  "company": {{json .Company}},
+  "//": "Identifies the product across versions, keep it unchanged.",
+  "upgrade-code": {{json .UpgradeCode}},
+{{- if .License}}
+  "//": "Shown by the installer, converted to RTF when needed.",
+  "license": {{json .License}},
+{{- end}}
+  "//": "The files are installed in the program files directory, the paths are relative to this manifest.",
+  "files": [
+{{- range $i, $e := .Executables}}{{if $i}},{{end}}
+    {
+      "//": {{json (printf "Built with: GOOS=windows go build -o %s %s" $e.Output $e.Package)}},
+      "path": {{json $e.Path}}
+{{- if and $.Service (eq $e.Name $.ServiceExecutable)}},
+      "//": "Runs the program as a Windows service.",
+      "service": {
+        "name": {{json $.Service}},
+        "start": "auto",
+        "display-name": {{json $.Product}}
+      }
+{{- end}}
+    }
+{{- end}}
+  ]
+{{- with index .Executables 0}}{{if $.Shortcut}},
+  "//": "Start menu shortcut to the program.",
+  "shortcuts": [
+    {
+      "name": {{json $.Product}},
+      "description": {{json $.Product}},
+      "location": "program",
+      "target": {{json (printf "[INSTALLDIR]%s" .Name)}},
+      "wdir": "INSTALLDIR"
+    }
+  ]
+{{- end}}{{end}}
+}
+`))
+
+// ServiceExecutable returns the name of the executable run by the
+// service, the one named after it or the first one.
+func (s *Starter) ServiceExecutable() string {
+	for _, e := range s.Executables {
+		if strings.EqualFold(e.Name, s.Service+".exe") {
+			return e.Name
+		}
+	}
+	return s.Executables[0].Name
+}
+
+// Write writes the starter manifest to w.
+func (s *Starter) Write(w io.Writer) error {
+	if len(s.Executables) == 0 {
+		return fmt.Errorf("no executable to install")
+	}
+	return starter.Execute(w, s)
+}
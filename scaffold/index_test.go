@@ -0,0 +1,60 @@
+package scaffold
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadModule(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+	write("go.mod", "module github.com/acme/hello/v2\n\ngo 1.18\n")
+	write("cmd/hello/main.go", "package main\n\nfunc main() {}\n")
+	write("cmd/hellod/main.go", "package main\n\nfunc main() {}\n")
+	write("cmd/hellod/main_test.go", "package main\n")
+	write("internal/lib/lib.go", "package lib\n")
+	write("tools/gen.go", "//go:build ignore\n\npackage main\n\nfunc main() {}\n")
+	write("vendor/x/main.go", "package main\n\nfunc main() {}\n")
+	write("examples/go.mod", "module example\n")
+	write("examples/main.go", "package main\n\nfunc main() {}\n")
+
+	m, err := ReadModule(dir)
+	require.NoError(t, err)
+	require.Equal(t, "github.com/acme/hello/v2", m.Path)
+	require.Equal(t, []string{"cmd/hello", "cmd/hellod"}, m.Mains)
+	require.Equal(t, "hello", m.Name())
+	require.Equal(t, "acme", m.Owner())
+
+	s, err := NewStarter(m, m.Mains, filepath.Join(dir, "packaging", "wix.json"))
+	require.NoError(t, err)
+	s.License = "../LICENSE"
+	s.Service = "hellod"
+	var b bytes.Buffer
+	require.NoError(t, s.Write(&b))
+
+	wixFile := manifest.WixManifest{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &wixFile), b.String())
+	require.Equal(t, "hello", wixFile.Product)
+	require.Equal(t, "acme", wixFile.Company)
+	require.Equal(t, s.UpgradeCode, wixFile.UpgradeCode)
+	require.Equal(t, "../LICENSE", wixFile.License)
+	require.Len(t, wixFile.Files, 2)
+	require.Equal(t, "../build/hello.exe", wixFile.Files[0].Path)
+	require.Nil(t, wixFile.Files[0].Service)
+	require.Equal(t, "hellod", wixFile.Files[1].Service.Name)
+	require.Equal(t, "[INSTALLDIR]hello.exe", wixFile.Shortcuts[0].Target)
+	require.Contains(t, b.String(), `"//": "Built with: GOOS=windows go build -o build/hellod.exe ./cmd/hellod"`)
+
+	_, err = ReadModule(filepath.Join(dir, "cmd"))
+	require.Error(t, err)
+}
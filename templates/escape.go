@@ -0,0 +1,96 @@
+package templates
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Raw is a value written as is by the XML templates, for markup.
+type Raw string
+
+// escapeFunc is appended to the actions of the XML templates.
+const escapeFunc = "escapeXML"
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
+func escapeXML(v interface{}) string {
+	switch v := v.(type) {
+	case Raw:
+		return string(v)
+	case nil:
+		return ""
+	}
+	return xmlEscaper.Replace(fmt.Sprint(printable(reflect.ValueOf(v))))
+}
+
+// printable returns the value printed by an action, pointers are
+// followed unless they implement fmt.Stringer or error.
+func printable(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Ptr && !v.IsNil() && !v.Type().Implements(stringerType) && !v.Type().Implements(errorType) {
+		v = v.Elem()
+	}
+	return v.Interface()
+}
+
+var (
+	stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// IsXML tells whether the values written by the template of the
+// given name are escaped.
+func IsXML(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".wxs", ".wxl", ".wxi", ".nuspec", ".xml":
+		return true
+	}
+	return false
+}
+
+// escapeActions escapes the values written by the actions of all the
+// templates of tpl, the variable declarations write nothing.
+func escapeActions(tpl *template.Template) {
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) > 0 {
+				return
+			}
+			last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]
+			if id, ok := last.Args[0].(*parse.IdentifierNode); ok && id.Ident == escapeFunc && len(last.Args) == 1 {
+				return
+			}
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      n.Pos,
+				Args:     []parse.Node{parse.NewIdentifier(escapeFunc).SetPos(n.Pos)},
+			})
+		case *parse.IfNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package templates
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/observiq/go-msi/rtf"
+	"github.com/observiq/go-msi/util"
+)
+
+// Options configures the template functions.
+type Options struct {
+	CacheDir string                    // directory of the cache of the downloads, no cache if empty
+	Offline  bool                      // download reads the cache instead of the network
+	Inputs   func(fn, arg, sum string) // if set, called with the sha256 of what cat, download and sha256 read
+}
+
+var httpClient = &http.Client{Timeout: time.Minute}
+
+// funcs returns the functions of the templates generating a file in
+// the dir directory. Relative paths are resolved against dir, like the
+// paths of the WiX sources, then against the working directory.
+func funcs(wixFile *manifest.WixManifest, dir string, opts Options) template.FuncMap {
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		if _, err := os.Stat(filepath.Join(dir, p)); err == nil {
+			return filepath.Join(dir, p)
+		}
+		return p
+	}
+	input := func(fn, arg, sum string) {
+		if opts.Inputs != nil {
+			opts.Inputs(fn, arg, sum)
+		}
+	}
+	return template.FuncMap{
+		"dec": func(i int) int {
+			return i - 1
+		},
+		"inc": func(i int) int {
+			return i + 1
+		},
+		"cat": func(filename string) (string, error) {
+			out, err := ioutil.ReadFile(resolve(filename))
+			if err != nil {
+				return "", err
+			}
+			input("cat", filename, sha256Sum(out))
+			return string(out), nil
+		},
+		"download": func(url string) (string, error) {
+			out, err := download(url, opts)
+			if err != nil {
+				return "", err
+			}
+			input("download", url, sha256Sum([]byte(out)))
+			return out, nil
+		},
+		"upper":    strings.ToUpper,
+		"pathJoin": filepath.Join,
+		"winPath": func(p string) string {
+			return strings.ReplaceAll(p, "/", `\`)
+		},
+		"guid": func(name string) (string, error) {
+			guid := wixFile.ComponentGUID(name)
+			if guid == "*" {
+				return "", fmt.Errorf(`Invalid "upgrade-code" value to derive a guid: %s`, wixFile.UpgradeCode)
+			}
+			return guid, nil
+		},
+		"toRtf": rtf.ToRtf,
+		"sha256": func(filename string) (string, error) {
+			sum, err := util.ComputeSha256(resolve(filename))
+			if err != nil {
+				return "", err
+			}
+			input("sha256", filename, sum)
+			return sum, nil
+		},
+		"fileByPath": func(installPath string) (manifest.File, error) {
+			p := strings.ToLower(filepath.ToSlash(filepath.Clean(installPath)))
+			for _, file := range wixFile.AllFiles() {
+				if strings.ToLower(filepath.ToSlash(file.InstallPath)) == p {
+					return file, nil
+				}
+			}
+			return manifest.File{}, fmt.Errorf("no file installed as %q in the manifest", installPath)
+		},
+		"raw": func(s string) Raw {
+			return Raw(s)
+		},
+		escapeFunc: escapeXML,
+	}
+}
+
+func sha256Sum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// download returns the content at url, stored in the cache. Offline,
+// the content comes from the cache only.
+func download(url string, opts Options) (string, error) {
+	var cached string
+	if opts.CacheDir != "" {
+		sum := sha256.Sum256([]byte(url))
+		cached = filepath.Join(opts.CacheDir, "downloads", hex.EncodeToString(sum[:]))
+	}
+	if opts.Offline {
+		if cached == "" {
+			return "", fmt.Errorf("cannot download %q offline without a cache", url)
+		}
+		out, err := ioutil.ReadFile(cached)
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("cannot download %q offline, it is not in the cache %s", url, opts.CacheDir)
+		}
+		return string(out), err
+	}
+
+	response, err := httpClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("failed to download %q: %s", url, response.Status)
+	}
+	out, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if cached != "" {
+		if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+			return "", err
+		}
+		tmp := cached + ".tmp"
+		if err := ioutil.WriteFile(tmp, out, 0644); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, cached); err != nil {
+			return "", err
+		}
+	}
+	return string(out), nil
+}
@@ -1,70 +1,182 @@
 package templates
 
 import (
-	"bytes"
+	"embed"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
-	"strings"
+	"sort"
 	"text/template"
 
-	"github.com/bmatcuk/doublestar"
 	"github.com/observiq/go-msi/manifest"
 )
 
-var funcMap = template.FuncMap{
-	"dec": func(i int) int {
-		return i - 1
-	},
-	"inc": func(i int) int {
-		return i + 1
-	},
-	"cat": func(filename string) string {
-		out, err := ioutil.ReadFile(filename)
-		if err != nil {
-			panic(fmt.Errorf("failed to read file %q", filename))
-		}
-		return string(out)
-	},
-	"download": func(url string) string {
-		response, err := http.Get(url)
-		if err != nil {
-			panic(fmt.Errorf("failed to download url %q", url))
-		}
-		defer response.Body.Close()
-		var b bytes.Buffer
-		if _, err := io.Copy(&b, response.Body); err != nil {
-			panic(fmt.Errorf("failed to download url %q", url))
+// defaults holds the default templates, built into the binary.
+//
+//go:embed *.wxs bundle module patch wixl choco
+var defaults embed.FS
+
+// PartialPattern matches the partial templates of a directory, their
+// {{define}} replace the {{block}} of the templates.
+const PartialPattern = "*.tmpl"
+
+// Defaults returns the default templates of the sub directory, all of
+// them if sub is empty.
+func Defaults(sub string) (fs.FS, error) {
+	if sub == "" {
+		return defaults, nil
+	}
+	return fs.Sub(defaults, sub)
+}
+
+// Overlay returns the templates of the src directory over the defaults
+// of the sub directory. src mirrors the templates folder, like the
+// directory written by Eject: a file of its sub directory replaces the
+// default of the same path, the other files are added. An empty src, or
+// one without the sub directory, returns the defaults.
+func Overlay(src, sub string) (fs.FS, error) {
+	base, err := Defaults(sub)
+	if err != nil {
+		return nil, err
+	}
+	if src == "" {
+		return base, nil
+	}
+	if info, err := os.Stat(src); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("templates %q is not a directory", src)
+	}
+	dir := filepath.Join(src, filepath.FromSlash(sub))
+	if info, err := os.Stat(dir); os.IsNotExist(err) {
+		return base, nil
+	} else if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("templates %q is not a directory", dir)
+	}
+	return &overlay{top: os.DirFS(dir), base: base}, nil
+}
+
+type overlay struct {
+	top  fs.FS
+	base fs.FS
+}
+
+func (o *overlay) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+	return f, err
+}
+
+// ReadDir merges the entries of both directories.
+func (o *overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	top, topErr := fs.ReadDir(o.top, name)
+	base, baseErr := fs.ReadDir(o.base, name)
+	if topErr != nil && baseErr != nil {
+		return nil, baseErr
+	}
+	entries := map[string]fs.DirEntry{}
+	for _, e := range base {
+		entries[e.Name()] = e
+	}
+	for _, e := range top {
+		entries[e.Name()] = e
+	}
+	res := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res, nil
+}
+
+// Find returns the templates of dir matching pattern, the partials are
+// left out.
+func Find(fsys fs.FS, dir, pattern string) ([]string, error) {
+	matches, err := fs.Glob(fsys, path.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	tpls := []string{}
+	for _, m := range matches {
+		if ok, _ := path.Match(PartialPattern, path.Base(m)); !ok {
+			tpls = append(tpls, m)
 		}
-		return b.String()
-	},
-	"upper": strings.ToUpper,
+	}
+	return tpls, nil
 }
 
-// Find all wxs files in given directory
-func Find(srcDir string, pattern string) ([]string, error) {
-	glob := filepath.Join(srcDir, pattern)
-	return doublestar.Glob(glob)
+// Partials returns the partial templates of dir.
+func Partials(fsys fs.FS, dir string) ([]string, error) {
+	return fs.Glob(fsys, path.Join(dir, PartialPattern))
 }
 
-// GenerateTemplate generates given src template to out file using given manifest
-func GenerateTemplate(wixFile *manifest.WixManifest, src string, out string) error {
-	tpl, err := template.New("").Funcs(funcMap).ParseFiles(src)
+// GenerateTemplate generates the src template of fsys to out file using
+// given manifest, along with the partials of its directory. The values
+// written by XML templates are escaped, unless given to raw.
+func GenerateTemplate(wixFile *manifest.WixManifest, fsys fs.FS, src string, out string, opts Options) error {
+	tpl := template.New(path.Base(src)).Funcs(funcs(wixFile, filepath.Dir(out), opts))
+	names, err := Partials(fsys, path.Dir(src))
 	if err != nil {
 		return err
 	}
+	for _, name := range append([]string{src}, names...) {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if _, err := tpl.New(path.Base(name)).Parse(string(content)); err != nil {
+			return err
+		}
+	}
+	if IsXML(src) {
+		escapeActions(tpl)
+	}
 
 	fileWriter, err := os.Create(out)
 	if err != nil {
 		return err
 	}
 	defer fileWriter.Close()
-	err = tpl.ExecuteTemplate(fileWriter, filepath.Base(src), wixFile)
+	err = tpl.ExecuteTemplate(fileWriter, path.Base(src), wixFile)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Eject writes the default templates to the out directory, it does not
+// overwrite existing files.
+func Eject(out string) ([]string, error) {
+	written := []string{}
+	err := fs.WalkDir(defaults, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(out, filepath.FromSlash(p))
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		content, err := defaults.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(content); err != nil {
+			f.Close()
+			return err
+		}
+		written = append(written, dst)
+		return f.Close()
+	})
+	return written, err
+}
@@ -0,0 +1,242 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlay(t *testing.T) {
+	src := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(src, name), []byte(content), 0644))
+	}
+	write("product.wxs", `<Wix>{{block "NAME" .}}default{{end}}</Wix>`)
+	write("name.tmpl", `{{define "NAME"}}{{.Product}}{{end}}`)
+
+	fsys, err := Overlay(src, "")
+	require.NoError(t, err)
+	tpls, err := Find(fsys, ".", "*.wxs")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dialogs_HK.wxs", "LicenseAgreementDlg_HK.wxs", "WixUI_HK.wxs", "product.wxs"}, tpls)
+
+	out := filepath.Join(t.TempDir(), "product.wxs")
+	require.NoError(t, GenerateTemplate(&manifest.WixManifest{Product: "hello"}, fsys, "product.wxs", out, Options{}))
+	content, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "<Wix>hello</Wix>", string(content))
+
+	// the other directories keep the defaults
+	wixl, err := Find(fsys, "wixl", "*.wxs")
+	require.NoError(t, err)
+	require.Equal(t, []string{"wixl/product.wxs"}, wixl)
+
+	_, err = Overlay(filepath.Join(src, "missing"), "")
+	require.Error(t, err)
+}
+
+func TestEject(t *testing.T) {
+	out := t.TempDir()
+	written, err := Eject(out)
+	require.NoError(t, err)
+	require.Contains(t, written, filepath.Join(out, "bundle", "bundle.wxs"))
+
+	// the ejected directory is the --src of every command
+	fsys, err := Overlay(out, "choco")
+	require.NoError(t, err)
+	tpls, err := fs.Glob(fsys, "*")
+	require.NoError(t, err)
+	require.Len(t, tpls, 5)
+	require.NoError(t, os.WriteFile(filepath.Join(out, "bundle", "extra.wxs"), []byte("<Wix/>"), 0644))
+	fsys, err = Overlay(out, "bundle")
+	require.NoError(t, err)
+	tpls, err = Find(fsys, ".", "*.wxs")
+	require.NoError(t, err)
+	require.Equal(t, []string{"bundle.wxs", "extra.wxs"}, tpls)
+
+	// a src without the sub directory keeps the defaults
+	fsys, err = Overlay(t.TempDir(), "patch")
+	require.NoError(t, err)
+	tpls, err = Find(fsys, ".", "*.wxs")
+	require.NoError(t, err)
+	require.Equal(t, []string{"patch.wxs"}, tpls)
+
+	_, err = Eject(out)
+	require.Error(t, err)
+}
+
+func TestEscape(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "a&b.exe")
+	require.NoError(t, os.WriteFile(exe, []byte("hello"), 0644))
+	wixFile, err := manifest.NewBuilder(`a<b>"c"`, "AT&T", "{5A2A43F4-1BC3-4A73-8B5C-6D2B5A1B8A1D}").
+		Version("0.0.1").
+		AddFile("", manifest.File{Path: exe}).
+		AddProperty("MODE", `say "hi" & <bye>`).
+		AddCondition(manifest.Condition{Condition: `VersionNT >= 600 AND MODE <> "1"`, Message: "Windows < Vista"}).
+		AddRegistry(manifest.RegistryItem{
+			Registry: manifest.Registry{Path: `HKCU\Software\AT&T`},
+			Values:   []manifest.RegistryValue{{Name: "it's", Value: `"quoted" & <tagged>`}},
+		}).
+		AddHook(manifest.Hook{Command: `[INSTALLDIR]a&b.exe --x="<1>"`, When: "install", Condition: `MODE <> "quiet"`}).
+		Build()
+	require.NoError(t, err)
+	require.NoError(t, wixFile.Normalize())
+
+	var values []string
+	for _, name := range []string{"wixl/product.wxs", "product.wxs"} {
+		out := filepath.Join(dir, "out.wxs")
+		require.NoError(t, GenerateTemplate(wixFile, defaults, name, out, Options{}))
+		content, err := os.ReadFile(out)
+		require.NoError(t, err)
+
+		values = []string{}
+		d := xml.NewDecoder(bytes.NewReader(content))
+		for {
+			tok, err := d.Token()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, name)
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				for _, attr := range tok.Attr {
+					values = append(values, attr.Value)
+				}
+			case xml.CharData:
+				values = append(values, strings.TrimSpace(string(tok)))
+			}
+		}
+		require.Contains(t, values, "AT&T", name)
+		require.Contains(t, values, `a<b>"c"`, name)
+		require.Contains(t, values, `say "hi" & <bye>`, name)
+		require.Contains(t, values, `VersionNT >= 600 AND MODE <> "1"`, name)
+		require.Contains(t, values, `Software\AT&T`, name)
+		require.Contains(t, values, `"quoted" & <tagged>`, name)
+	}
+	// wixl does not support hooks, product.wxs is the last one
+	require.Contains(t, values, `"[INSTALLDIR]a&b.exe" --x="<1>"`)
+	require.Contains(t, values, `NOT Installed AND NOT REMOVE AND (MODE <> "quiet")`)
+}
+
+func TestRaw(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a.wxs"),
+		[]byte(`<a n="{{.Product}}">{{raw .Company}}{{$c := .Company}}{{with $c}}{{.}}{{end}}</a>`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a.txt"), []byte(`{{.Company}}`), 0644))
+	fsys, err := Overlay(src, "")
+	require.NoError(t, err)
+
+	out := filepath.Join(t.TempDir(), "out")
+	wixFile := &manifest.WixManifest{Product: `"x"`, Company: "<b>&</b>"}
+	require.NoError(t, GenerateTemplate(wixFile, fsys, "a.wxs", out, Options{}))
+	content, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, `<a n="&quot;x&quot;"><b>&</b>&lt;b&gt;&amp;&lt;/b&gt;</a>`, string(content))
+
+	require.NoError(t, GenerateTemplate(wixFile, fsys, "a.txt", out, Options{}))
+	content, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "<b>&</b>", string(content))
+}
+
+func TestFuncs(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "hello.exe")
+	require.NoError(t, os.WriteFile(exe, []byte("hello"), 0644))
+	wixFile, err := manifest.NewBuilder("hello", "acme", "{5A2A43F4-1BC3-4A73-8B5C-6D2B5A1B8A1D}").
+		Version("0.0.1").
+		AddFile("bin", manifest.File{Path: exe, Permanent: true}).
+		Build()
+	require.NoError(t, err)
+	require.NoError(t, wixFile.AssignIDs())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/license" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("MIT {license}"))
+	}))
+	defer server.Close()
+
+	render := func(content string, opts Options) (string, error) {
+		src := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(src, "a.txt"), []byte(content), 0644))
+		fsys, err := Overlay(src, "")
+		require.NoError(t, err)
+		out := filepath.Join(dir, "out.txt")
+		if err := GenerateTemplate(wixFile, fsys, "a.txt", out, opts); err != nil {
+			return "", err
+		}
+		b, err := os.ReadFile(out)
+		return string(b), err
+	}
+
+	out, err := render(`{{winPath (pathJoin "a" "b")}} {{guid "x"}} {{sha256 "hello.exe"}} {{(fileByPath "BIN/hello.exe").Permanent}}`, Options{})
+	require.NoError(t, err)
+	require.Equal(t, `a\b `+wixFile.ComponentGUID("x")+` 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824 true`, out)
+
+	_, err = render(`{{fileByPath "missing.exe"}}`, Options{})
+	require.EqualError(t, err, `template: a.txt:1:2: executing "a.txt" at <fileByPath "missing.exe">: error calling fileByPath: no file installed as "missing.exe" in the manifest`)
+	_, err = render(`{{cat "missing.txt"}}`, Options{})
+	require.Error(t, err)
+
+	cache := t.TempDir()
+	tpl := `{{download "` + server.URL + `/license" | toRtf}}`
+	_, err = render(tpl, Options{CacheDir: cache, Offline: true})
+	require.Error(t, err)
+	out, err = render(tpl, Options{CacheDir: cache})
+	require.NoError(t, err)
+	require.Equal(t, "{\\rtf1\\ansi\r\nMIT \\{license\\}\r\n}", out)
+	server.Close()
+	offline, err := render(tpl, Options{CacheDir: cache, Offline: true})
+	require.NoError(t, err)
+	require.Equal(t, out, offline)
+
+	_, err = render(`{{download "`+server.URL+`/missing"}}`, Options{CacheDir: cache})
+	require.Error(t, err)
+}
+
+func TestBundleLicense(t *testing.T) {
+	tests := []struct {
+		name       string
+		license    string
+		licenseURL string
+		want       string
+		notWant    string
+	}{
+		{name: "license file", license: "LICENSE.rtf", want: `LicenseFile="LICENSE.rtf"`, notWant: "LicenseUrl"},
+		{name: "license url", licenseURL: "https://example.com/license", want: `LicenseUrl="https://example.com/license"`},
+		{name: "no license", want: "WixStandardBootstrapperApplication.HyperlinkLicense", notWant: "LicenseUrl"},
+	}
+	fsys, err := Defaults("bundle")
+	require.NoError(t, err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wixFile := &manifest.WixManifest{
+				Product: "hello",
+				License: test.license,
+				Bundle:  &manifest.Bundle{Name: "hello", LicenseURL: test.licenseURL},
+			}
+			out := filepath.Join(t.TempDir(), "bundle.wxs")
+			require.NoError(t, GenerateTemplate(wixFile, fsys, "bundle.wxs", out, Options{}))
+			content, err := os.ReadFile(out)
+			require.NoError(t, err)
+			require.Contains(t, string(content), test.want)
+			if test.notWant != "" {
+				require.NotContains(t, string(content), test.notWant)
+			}
+		})
+	}
+}
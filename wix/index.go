@@ -1,38 +1,552 @@
 package wix
 
 import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/observiq/go-msi/manifest"
+	"github.com/observiq/go-msi/util"
 )
 
 var eol = "\r\n"
 
-// GenerateCmd generates required command lines to produce an msi package,
-func GenerateCmd(wixFile *manifest.WixManifest, templates []string, msiOutFile, arch, path string) string {
+// Toolset is the WiX toolset building the packages.
+type Toolset string
 
-	cmd := ""
+const (
+	// Wix3 is the WiX 3 toolset, candle and light.
+	Wix3 Toolset = "wix3"
+	// Wix4 is the WiX 4 and later toolset, the wix dotnet tool.
+	Wix4 Toolset = "wix4"
+	// Wixl is the wixl tool of msitools, it runs on linux.
+	Wixl Toolset = "wixl"
+)
 
-	cmd += filepath.Join(path, "candle") + " -ext WixUtilExtension"
-	if arch != "" {
-		if arch == "386" {
-			arch = "x86"
-		} else if arch == "amd64" {
-			arch = "x64"
+// Wix4Extensions are the extensions the generated sources depend on
+// with the WiX 4 toolset.
+var Wix4Extensions = []string{"WixToolset.UI.wixext", "WixToolset.Util.wixext", "WixToolset.Bal.wixext"}
+
+// SelectToolset returns the toolset of the given name, auto selects the
+// WiX 4 toolset when the wix tool is found in path, the wixl toolset when
+// wixl is found out of windows, the WiX 3 toolset otherwise.
+func SelectToolset(name, path string) (Toolset, error) {
+	switch name {
+	case "wix3":
+		return Wix3, nil
+	case "wix4":
+		return Wix4, nil
+	case "wixl":
+		return Wixl, nil
+	case "", "auto":
+		if _, err := util.Exec(filepath.Join(path, "wix"), "--version"); err == nil {
+			return Wix4, nil
 		}
-		cmd += " -arch " + arch
+		if runtime.GOOS != "windows" {
+			if _, err := util.Exec(filepath.Join(path, "wixl"), "--version"); err == nil {
+				return Wixl, nil
+			}
+		}
+		return Wix3, nil
 	}
-	for _, tpl := range templates {
-		cmd += " " + filepath.Base(tpl)
+	return "", fmt.Errorf("invalid toolset %q, must be one of wix3, wix4, wixl, auto", name)
+}
+
+// Check tells if the toolset can build the manifest.
+func (t Toolset) Check(wixFile *manifest.WixManifest) error {
+	if t != Wixl {
+		return nil
+	}
+	unsupported := func(what string) error {
+		return fmt.Errorf("%s not supported by the wixl toolset, use the wix3 or wix4 toolset", what)
+	}
+	switch {
+	case wixFile.Kind == "module":
+		return unsupported("merge module authoring is")
+	case len(wixFile.MergeModules) > 0:
+		return unsupported("merge modules are")
+	case len(wixFile.Languages) > 0:
+		return unsupported("languages are")
+	case len(wixFile.Dialogs) > 0:
+		return unsupported("dialogs are")
+	case wixFile.UI != nil && (wixFile.UI.Launch != nil || (wixFile.UI.Mode != "" && wixFile.UI.Mode != "none")):
+		return unsupported("the user interface is")
+	case len(wixFile.Hooks) > 0:
+		return unsupported("hooks are")
+	case len(wixFile.Environments) > 0:
+		return unsupported("environments are")
+	case wixFile.Upgrade != nil && (wixFile.Upgrade.AllowDowngrades || wixFile.Upgrade.AllowSameVersion || wixFile.Upgrade.Schedule != "" || len(wixFile.Upgrade.Legacy) > 0):
+		return unsupported("upgrade options other than downgrade-message are")
+	}
+	for _, p := range wixFile.Properties {
+		if p.Registry != nil {
+			return unsupported(fmt.Sprintf("property %s read from the registry is", p.ID))
+		}
+	}
+	for _, s := range wixFile.Shortcuts {
+		if len(s.Properties) > 0 {
+			return unsupported(fmt.Sprintf("shortcut %s properties are", s.Name))
+		}
+	}
+	var checkServices func(dir manifest.Directory) error
+	checkServices = func(dir manifest.Directory) error {
+		for _, file := range dir.Files {
+			if file.Service != nil && (file.Service.Delayed || len(file.Service.Dependencies) > 0) {
+				return unsupported(fmt.Sprintf("delayed start and dependencies of service %s are", file.Service.Name))
+			}
+		}
+		for _, sub := range dir.Directories {
+			if err := checkServices(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return checkServices(wixFile.Directory)
+}
+
+var toolVersion = regexp.MustCompile(`[0-9]+(\.[0-9]+)+`)
+
+// Version returns the version printed by the main tool of the toolset
+// found in path, empty if it is not found.
+func (t Toolset) Version(path string) string {
+	tool, arg := "candle", "-h"
+	switch t {
+	case Wix4:
+		tool, arg = "wix", "--version"
+	case Wixl:
+		tool, arg = "wixl", "--version"
+	}
+	out, _ := util.Exec(filepath.Join(path, tool), arg)
+	return toolVersion.FindString(out)
+}
+
+// GenerateCmd generates the commands to produce an msi package with the toolset.
+func (t Toolset) GenerateCmd(wixFile *manifest.WixManifest, templates []string, msiOutFile, arch, path string) []Command {
+	switch t {
+	case Wix4:
+		return generateWix4Cmd(wixFile, templates, msiOutFile, arch, path)
+	case Wixl:
+		return generateWixlCmd(templates, msiOutFile, arch, path)
+	}
+	return GenerateCmd(wixFile, templates, msiOutFile, arch, path)
+}
+
+// ReproducibleCmd pins the dates of the packages built by the commands
+// to date. wixl reads it from the SOURCE_DATE_EPOCH variable while the
+// summary information of the packages built by the WiX tools is rewritten
+// with MsiInfo, along with a package code per culture.
+func (t Toolset) ReproducibleCmd(wixFile *manifest.WixManifest, cmds []Command, msiOutFile string, date time.Time) []Command {
+	if t == Wixl {
+		for i := range cmds {
+			cmds[i].Env = append(cmds[i].Env, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", date.Unix()))
+		}
+		return cmds
+	}
+	stamp := date.UTC().Format("2006/01/02 15:04:05")
+	msiInfo := func(out, code string) {
+		args := []string{out, "/r", stamp, "/q", stamp, "/s", stamp}
+		if code != "" {
+			args = append(args, "/v", code)
+		}
+		cmds = append(cmds, Command{Name: "MsiInfo", Args: args})
+	}
+	if len(wixFile.Languages) == 0 {
+		msiInfo(msiOutFile, "")
+	}
+	for _, lang := range wixFile.Languages {
+		msiInfo(CultureOutFile(msiOutFile, lang.Culture), CulturePackageCode(wixFile.PackageCode, lang.Culture))
+	}
+	return cmds
+}
+
+// CheckReproducible tells if the tool pinning the dates of the packages
+// is found, MsiInfo of the Windows SDK for the WiX tools.
+func (t Toolset) CheckReproducible() error {
+	if t == Wixl {
+		return nil
+	}
+	if _, err := exec.LookPath("MsiInfo"); err == nil {
+		return nil
+	}
+	if runtime.GOOS != "windows" {
+		if _, err := exec.LookPath("MsiInfo.exe"); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("MsiInfo not found, reproducible builds with the %s toolset require MsiInfo.exe of the Windows SDK in PATH", t)
+}
+
+// CulturePackageCode returns the package code of the package of the culture
+// derived from the package code of the manifest, empty if not set.
+func CulturePackageCode(packageCode, culture string) string {
+	namespace, err := uuid.Parse(packageCode)
+	if err != nil {
+		return ""
+	}
+	return "{" + strings.ToUpper(uuid.NewSHA1(namespace, []byte(culture)).String()) + "}"
+}
+
+// GenerateBundleCmd generates the commands to produce a setup executable with the toolset.
+func (t Toolset) GenerateBundleCmd(wixFile *manifest.WixManifest, templates []string, exeOutFile, arch, path string) ([]Command, error) {
+	switch t {
+	case Wix4:
+		return generateWix4BundleCmd(templates, exeOutFile, arch, path), nil
+	case Wixl:
+		return nil, fmt.Errorf("bundles are not supported by the wixl toolset, use the wix3 or wix4 toolset")
+	}
+	return GenerateBundleCmd(wixFile, templates, exeOutFile, arch, path), nil
+}
+
+// GeneratePatchCmd generates the commands to produce a msp patch with the toolset.
+func (t Toolset) GeneratePatchCmd(wixFile *manifest.WixManifest, templates []string, oldMsi, newMsi, mspOutFile, path string) ([]Command, error) {
+	if t != Wix3 {
+		return nil, fmt.Errorf("patches are only supported by the wix3 toolset")
+	}
+	return GeneratePatchCmd(wixFile, templates, oldMsi, newMsi, mspOutFile, path), nil
+}
+
+// Command is a command line of the build.
+type Command struct {
+	Name        string   `json:"name"`
+	Args        []string `json:"args"`
+	IgnoreError bool     `json:"ignore-error,omitempty"` // a non-zero exit code is not a failure, the command must run though
+	Env         []string `json:"env,omitempty"`          // added to the environment as NAME=value
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Run runs the commands in the dir directory and writes their output to w,
+// the output of a failed command is returned with its error.
+// Out of windows, the tools only found with the .exe extension run with wine.
+// The running command is killed when the context is done.
+func Run(ctx context.Context, cmds []Command, dir string, w io.Writer) error {
+	for _, c := range cmds {
+		name, args := c.Name, c.Args
+		if runtime.GOOS != "windows" {
+			if _, err := exec.LookPath(name); err != nil {
+				if exe, err := exec.LookPath(name + ".exe"); err == nil {
+					name, args = "wine", append([]string{exe}, args...)
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Dir = dir
+		if len(c.Env) > 0 {
+			cmd.Env = append(os.Environ(), c.Env...)
+		}
+		out, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		if err != nil && (!c.IgnoreError || !errors.As(err, &exitErr)) {
+			return fmt.Errorf("%s failed with %v\n%s", c, err, out)
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Script returns the commands as a script of the given format,
+// bat, sh or ps1, stopping at the first failed command.
+func Script(cmds []Command, format string) (string, error) {
+	var b strings.Builder
+	switch format {
+	case "bat":
+		for _, c := range cmds {
+			for _, env := range c.Env {
+				b.WriteString(`set "` + strings.Replace(env, "%", "%%", -1) + `"` + eol)
+			}
+			b.WriteString(quoteArgs(c, batQuote) + eol)
+			if !c.IgnoreError {
+				b.WriteString("if errorlevel 1 exit /b 1" + eol)
+			}
+		}
+	case "sh":
+		b.WriteString("#!/bin/sh\nset -e\n")
+		for _, c := range cmds {
+			for _, env := range c.Env {
+				kv := strings.SplitN(env, "=", 2)
+				b.WriteString(kv[0] + "=" + shQuote(kv[len(kv)-1]) + " ")
+			}
+			b.WriteString(quoteArgs(c, shQuote))
+			if c.IgnoreError {
+				b.WriteString(" || true")
+			}
+			b.WriteString("\n")
+		}
+	case "ps1":
+		for _, c := range cmds {
+			for _, env := range c.Env {
+				kv := strings.SplitN(env, "=", 2)
+				b.WriteString("$env:" + kv[0] + " = '" + strings.Replace(kv[len(kv)-1], "'", "''", -1) + "'\r\n")
+			}
+			b.WriteString("& " + quoteArgs(c, psQuote) + "\r\n")
+			if !c.IgnoreError {
+				b.WriteString("if ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE }\r\n")
+			}
+		}
+	default:
+		return "", fmt.Errorf("invalid script format %q, must be one of bat, sh, ps1", format)
+	}
+	return b.String(), nil
+}
+
+func quoteArgs(c Command, quote func(string) string) string {
+	args := []string{quote(c.Name)}
+	for _, arg := range c.Args {
+		args = append(args, quote(arg))
+	}
+	return strings.Join(args, " ")
+}
+
+func batQuote(s string) string {
+	// a script expands %name% even within quotes
+	s = strings.Replace(s, "%", "%%", -1)
+	if s == "" || strings.ContainsAny(s, " \t&|<>^") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+func shQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t'\"\\$`!*?[]{}()<>|&;#~") {
+		return s
 	}
-	cmd += eol
-	cmd += filepath.Join(path, "light") + " -ext WixUIExtension -ext WixUtilExtension -sacl -spdb "
-	cmd += " -out " + msiOutFile
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func psQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t'\"$`&|<>(){}@;,") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// wixArch returns the -arch value of the WiX tools.
+func wixArch(arch string) string {
+	switch arch {
+	case "386":
+		return "x86"
+	case "amd64":
+		return "x64"
+	}
+	return arch
+}
+
+func wixobjs(templates []string) []string {
+	var objs []string
 	for _, tpl := range templates {
-		cmd += " " + strings.Replace(filepath.Base(tpl), ".wxs", ".wixobj", -1)
+		objs = append(objs, strings.Replace(filepath.Base(tpl), ".wxs", ".wixobj", -1))
+	}
+	return objs
+}
+
+func bases(files []string) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	return names
+}
+
+// GenerateCmd generates the commands to produce an msi package,
+// when the manifest is localized it produces an msi package per culture.
+func GenerateCmd(wixFile *manifest.WixManifest, templates []string, msiOutFile, arch, path string) []Command {
+
+	candle := Command{Name: filepath.Join(path, "candle"), Args: []string{"-ext", "WixUtilExtension"}}
+	if arch != "" {
+		candle.Args = append(candle.Args, "-arch", wixArch(arch))
+	}
+	candle.Args = append(candle.Args, bases(templates)...)
+	cmds := []Command{candle}
+
+	light := func(out string, loc ...string) {
+		args := []string{"-ext", "WixUIExtension", "-ext", "WixUtilExtension", "-sacl", "-spdb"}
+		args = append(args, loc...)
+		args = append(args, "-out", out)
+		args = append(args, wixobjs(templates)...)
+		cmds = append(cmds, Command{Name: filepath.Join(path, "light"), Args: args})
+	}
+	if len(wixFile.Languages) == 0 {
+		light(msiOutFile)
+	}
+	for _, lang := range wixFile.Languages {
+		loc := []string{"-cultures:" + lang.Culture, "-loc", LocalizationFile(lang.Culture)}
+		if lang.License != "" {
+			loc = append(loc, "-dLicenseRtf="+lang.License)
+		}
+		light(CultureOutFile(msiOutFile, lang.Culture), loc...)
+	}
+
+	return cmds
+}
+
+// CultureOutFile returns the path of the package localized for the given
+// culture, the culture is inserted before the file extension.
+func CultureOutFile(outFile, culture string) string {
+	ext := filepath.Ext(outFile)
+	return strings.TrimSuffix(outFile, ext) + "." + culture + ext
+}
+
+// LocalizationFile returns the name of the localization file of the given culture.
+func LocalizationFile(culture string) string {
+	return "product." + culture + ".wxl"
+}
+
+type localization struct {
+	XMLName  xml.Name            `xml:"http://schemas.microsoft.com/wix/2006/localization WixLocalization"`
+	Culture  string              `xml:"Culture,attr"`
+	Codepage string              `xml:"Codepage,attr"`
+	Strings  []localizationEntry `xml:"String"`
+}
+
+type localizationEntry struct {
+	ID    string `xml:"Id,attr"`
+	Value string `xml:",chardata"`
+}
+
+// GenerateLocalizations writes a localization file for each language
+// of the manifest into the out directory.
+func GenerateLocalizations(wixFile *manifest.WixManifest, out string) ([]string, error) {
+	var files []string
+	for _, lang := range wixFile.Languages {
+		loc := localization{
+			Culture:  lang.Culture,
+			Codepage: strconv.Itoa(lang.Codepage),
+		}
+		strs := wixFile.LocStrings(lang)
+		ids := make([]string, 0, len(strs))
+		for id := range strs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			loc.Strings = append(loc.Strings, localizationEntry{ID: id, Value: strs[id]})
+		}
+		b, err := xml.MarshalIndent(loc, "", "  ")
+		if err != nil {
+			return files, err
+		}
+		file := filepath.Join(out, LocalizationFile(lang.Culture))
+		if err := ioutil.WriteFile(file, append([]byte(xml.Header), b...), 0644); err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// GenerateBundleCmd generates the commands to produce a bundle
+// setup executable.
+func GenerateBundleCmd(wixFile *manifest.WixManifest, templates []string, exeOutFile, arch, path string) []Command {
+
+	candle := Command{Name: filepath.Join(path, "candle"), Args: []string{"-ext", "WixBalExtension", "-ext", "WixUtilExtension"}}
+	if arch != "" {
+		candle.Args = append(candle.Args, "-arch", wixArch(arch))
+	}
+	candle.Args = append(candle.Args, bases(templates)...)
+
+	light := Command{Name: filepath.Join(path, "light"), Args: []string{"-ext", "WixBalExtension", "-ext", "WixUtilExtension", "-spdb", "-out", exeOutFile}}
+	light.Args = append(light.Args, wixobjs(templates)...)
+
+	return []Command{candle, light}
+}
+
+// GeneratePatchCmd generates the commands to build a msp patch from
+// two msi releases.
+func GeneratePatchCmd(wixFile *manifest.WixManifest, templates []string, oldMsi, newMsi, mspOutFile, path string) []Command {
+
+	return []Command{
+		{Name: filepath.Join(path, "candle"), Args: bases(templates)},
+		{Name: filepath.Join(path, "light"), Args: append([]string{"-spdb", "-out", "patch.wixmsp"}, wixobjs(templates)...)},
+		{Name: filepath.Join(path, "torch"), Args: []string{"-p", "-xo", "-ax", "extracted", oldMsi, newMsi, "-out", "diff.wixmst"}},
+		{Name: filepath.Join(path, "pyro"), Args: []string{"patch.wixmsp", "-out", mspOutFile, "-t", "RTM", "diff.wixmst"}},
+	}
+}
+
+// wix4Convert converts the WiX 3 sources to the WiX 4 schema. wix convert
+// exits with the number of conversions it made, a dry run must then find
+// nothing left to convert, or the conversion failed.
+func wix4Convert(sources []string, path string) []Command {
+	name := filepath.Join(path, "wix")
+	return []Command{
+		{Name: name, Args: append([]string{"convert"}, bases(sources)...), IgnoreError: true},
+		{Name: name, Args: append([]string{"convert", "-dryrun"}, bases(sources)...)},
+	}
+}
+
+func generateWix4Cmd(wixFile *manifest.WixManifest, templates []string, msiOutFile, arch, path string) []Command {
+
+	sources := templates
+	for _, lang := range wixFile.Languages {
+		sources = append(sources[:len(sources):len(sources)], LocalizationFile(lang.Culture))
+	}
+	cmds := wix4Convert(sources, path)
+
+	build := func(out string, loc ...string) {
+		args := []string{"build", "-ext", "WixToolset.UI.wixext", "-ext", "WixToolset.Util.wixext", "-pdbtype", "none"}
+		if arch != "" {
+			args = append(args, "-arch", wixArch(arch))
+		}
+		args = append(args, loc...)
+		args = append(args, "-o", out)
+		args = append(args, bases(templates)...)
+		cmds = append(cmds, Command{Name: filepath.Join(path, "wix"), Args: args})
+	}
+	if len(wixFile.Languages) == 0 {
+		build(msiOutFile)
+	}
+	for _, lang := range wixFile.Languages {
+		loc := []string{"-culture", lang.Culture, "-loc", LocalizationFile(lang.Culture)}
+		if lang.License != "" {
+			loc = append(loc, "-bindvariable", "LicenseRtf="+lang.License)
+		}
+		build(CultureOutFile(msiOutFile, lang.Culture), loc...)
+	}
+
+	return cmds
+}
+
+func generateWix4BundleCmd(templates []string, exeOutFile, arch, path string) []Command {
+
+	args := []string{"build", "-ext", "WixToolset.Bal.wixext", "-ext", "WixToolset.Util.wixext", "-pdbtype", "none"}
+	if arch != "" {
+		args = append(args, "-arch", wixArch(arch))
+	}
+	args = append(args, "-o", exeOutFile)
+	args = append(args, bases(templates)...)
+
+	return append(wix4Convert(templates, path), Command{Name: filepath.Join(path, "wix"), Args: args})
+}
+
+func generateWixlCmd(templates []string, msiOutFile, arch, path string) []Command {
+
+	args := []string{"-o", msiOutFile}
+	if arch == "amd64" {
+		args = append(args, "-a", "x64", "-D", "Program_Files=ProgramFiles64Folder", "-D", "Win64=yes")
+	} else {
+		args = append(args, "-a", "x86", "-D", "Program_Files=ProgramFilesFolder", "-D", "Win64=no")
 	}
-	cmd += eol
+	args = append(args, bases(templates)...)
 
-	return cmd
+	return []Command{{Name: filepath.Join(path, "wixl"), Args: args}}
 }
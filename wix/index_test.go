@@ -0,0 +1,210 @@
+package wix
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observiq/go-msi/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the wixl stub is a shell script")
+	}
+	bin := t.TempDir()
+	out := t.TempDir()
+	// the detection runs wixl --version in the working directory, only
+	// the build records its arguments
+	stub := "#!/bin/sh\nif [ \"$1\" = --version ]; then echo 0.101; exit 0; fi\necho \"$PWD $@\" > wixl.args\n"
+	err := ioutil.WriteFile(filepath.Join(bin, "wixl"), []byte(stub), 0755)
+	require.NoError(t, err)
+
+	toolset, err := SelectToolset("auto", bin)
+	require.NoError(t, err)
+	require.Equal(t, Wixl, toolset)
+
+	cmds := toolset.GenerateCmd(&manifest.WixManifest{}, []string{filepath.Join(out, "product.wxs")}, "hello.msi", "amd64", bin)
+	var output bytes.Buffer
+	err = Run(context.Background(), cmds, out, &output)
+	require.NoError(t, err)
+
+	args, err := ioutil.ReadFile(filepath.Join(out, "wixl.args"))
+	require.NoError(t, err)
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NotEqual(t, dir, out)
+	require.Equal(t, out+" -o hello.msi -a x64 -D Program_Files=ProgramFiles64Folder -D Win64=yes product.wxs", strings.TrimSpace(string(args)))
+}
+
+func TestCheckWixl(t *testing.T) {
+	wixFile := &manifest.WixManifest{}
+	require.NoError(t, Wixl.Check(wixFile))
+
+	wixFile.UI = &manifest.UI{Mode: "none"}
+	require.NoError(t, Wixl.Check(wixFile))
+
+	wixFile.Languages = []manifest.Language{{Culture: "fr-fr"}}
+	require.NoError(t, Wix3.Check(wixFile))
+	err := Wixl.Check(wixFile)
+	require.EqualError(t, err, "languages are not supported by the wixl toolset, use the wix3 or wix4 toolset")
+	wixFile.Languages = nil
+
+	wixFile.Directories = []manifest.Directory{{
+		Files: []manifest.File{{Path: "svc.exe", Service: &manifest.Service{Name: "svc", Dependencies: []string{"other"}}}},
+	}}
+	require.Error(t, Wixl.Check(wixFile))
+}
+
+func TestScript(t *testing.T) {
+	cmds := []Command{
+		{Name: "wix", Args: []string{"convert", "product.wxs"}, IgnoreError: true},
+		{Name: "wix", Args: []string{"build", "-o", "my app.msi", "product.wxs"}},
+	}
+
+	script, err := Script(cmds, "bat")
+	require.NoError(t, err)
+	require.Equal(t, "wix convert product.wxs\r\nwix build -o \"my app.msi\" product.wxs\r\nif errorlevel 1 exit /b 1\r\n", script)
+
+	script, err = Script(cmds, "sh")
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\nset -e\nwix convert product.wxs || true\nwix build -o 'my app.msi' product.wxs\n", script)
+
+	script, err = Script(cmds, "ps1")
+	require.NoError(t, err)
+	require.Equal(t, "& wix convert product.wxs\r\n& wix build -o 'my app.msi' product.wxs\r\nif ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE }\r\n", script)
+
+	_, err = Script(cmds, "cmd")
+	require.Error(t, err)
+
+	script, err = Script([]Command{{Name: "wix", Args: []string{"build", "-o", "100%.msi", "-d", "Name=%USERNAME% app"}, Env: []string{"TAG=%date%"}}}, "bat")
+	require.NoError(t, err)
+	require.Equal(t, "set \"TAG=%%date%%\"\r\nwix build -o 100%%.msi -d \"Name=%%USERNAME%% app\"\r\nif errorlevel 1 exit /b 1\r\n", script)
+}
+
+func TestReproducibleCmd(t *testing.T) {
+	date := time.Unix(1700000000, 0)
+	wixFile := &manifest.WixManifest{PackageCode: "{6E5B6BB3-0D1A-4E28-9AE4-6C4C22A2D05E}"}
+
+	cmds := Wixl.ReproducibleCmd(wixFile, generateWixlCmd([]string{"product.wxs"}, "hello.msi", "amd64", ""), "hello.msi", date)
+	require.Equal(t, []string{"SOURCE_DATE_EPOCH=1700000000"}, cmds[0].Env)
+	script, err := Script(cmds, "sh")
+	require.NoError(t, err)
+	require.Contains(t, script, "\nSOURCE_DATE_EPOCH=1700000000 wixl -o hello.msi")
+
+	cmds = Wix3.ReproducibleCmd(wixFile, nil, "hello.msi", date)
+	require.Equal(t, []Command{{Name: "MsiInfo", Args: []string{"hello.msi", "/r", "2023/11/14 22:13:20", "/q", "2023/11/14 22:13:20", "/s", "2023/11/14 22:13:20"}}}, cmds)
+
+	wixFile.Languages = []manifest.Language{{Culture: "en-US"}, {Culture: "fr-FR"}}
+	cmds = Wix4.ReproducibleCmd(wixFile, nil, "hello.msi", date)
+	require.Len(t, cmds, 2)
+	require.Equal(t, "hello.fr-FR.msi", cmds[1].Args[0])
+	packageCode := func(c Command) string {
+		for i, arg := range c.Args {
+			if arg == "/v" && i+1 < len(c.Args) {
+				return c.Args[i+1]
+			}
+		}
+		return ""
+	}
+	require.Equal(t, CulturePackageCode(wixFile.PackageCode, "en-US"), packageCode(cmds[0]))
+	require.Equal(t, CulturePackageCode(wixFile.PackageCode, "fr-FR"), packageCode(cmds[1]))
+	require.NotEqual(t, packageCode(cmds[0]), packageCode(cmds[1]))
+}
+
+func TestCheckReproducible(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	require.NoError(t, Wixl.CheckReproducible())
+	require.EqualError(t, Wix3.CheckReproducible(), "MsiInfo not found, reproducible builds with the wix3 toolset require MsiInfo.exe of the Windows SDK in PATH")
+}
+
+func TestWix4Cmd(t *testing.T) {
+	wixFile := &manifest.WixManifest{Languages: []manifest.Language{
+		{Culture: "en-US"},
+		{Culture: "fr-FR", License: "LICENSE.fr.rtf"},
+	}}
+	cmds := Wix4.GenerateCmd(wixFile, []string{"product.wxs"}, "hello.msi", "amd64", "")
+	require.Len(t, cmds, 4)
+	require.Equal(t, Command{Name: "wix", Args: []string{"convert", "product.wxs", "product.en-US.wxl", "product.fr-FR.wxl"}, IgnoreError: true}, cmds[0])
+	require.Equal(t, Command{Name: "wix", Args: []string{"convert", "-dryrun", "product.wxs", "product.en-US.wxl", "product.fr-FR.wxl"}}, cmds[1])
+	require.NotContains(t, cmds[2].Args, "-bindvariable")
+	require.Contains(t, cmds[3].String(), " -bindvariable LicenseRtf=LICENSE.fr.rtf ")
+	require.NotContains(t, cmds[3].Args, "-d")
+}
+
+func TestRunIgnoreError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are shell commands")
+	}
+	var output bytes.Buffer
+	require.NoError(t, Run(context.Background(), []Command{{Name: "false", IgnoreError: true}}, t.TempDir(), &output))
+	require.Error(t, Run(context.Background(), []Command{{Name: "false"}}, t.TempDir(), &output))
+	require.Error(t, Run(context.Background(), []Command{{Name: filepath.Join(t.TempDir(), "missing"), IgnoreError: true}}, t.TempDir(), &output))
+}
+
+func TestGenerateLocalizations(t *testing.T) {
+	wixFile := &manifest.WixManifest{
+		Product:    "hello",
+		Conditions: []manifest.Condition{{Condition: "VersionNT >= 600", Message: "Windows Vista & later"}},
+	}
+	wixFile.Version.Display = "1.0.0"
+	tests := []struct {
+		name  string
+		lang  manifest.Language
+		file  string
+		wants []string
+	}{
+		{
+			name: "defaults",
+			lang: manifest.Language{Culture: "en-us", LCID: 1033, Codepage: 1252},
+			file: "product.en-us.wxl",
+			wants: []string{
+				`Culture="en-us" Codepage="1252"`,
+				`<String Id="ProductName">hello</String>`,
+				`<String Id="ProductLanguage">1033</String>`,
+				`<String Id="Condition0">Windows Vista &amp; later</String>`,
+			},
+		},
+		{
+			name: "translated",
+			lang: manifest.Language{
+				Culture:    "fr-fr",
+				LCID:       1036,
+				Codepage:   1252,
+				Strings:    map[string]string{"ProductComments": "Installe hello"},
+				Conditions: []string{"Windows Vista et suivants"},
+			},
+			file: "product.fr-fr.wxl",
+			wants: []string{
+				`<String Id="ProductComments">Installe hello</String>`,
+				`<String Id="Condition0">Windows Vista et suivants</String>`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wixFile.Languages = []manifest.Language{test.lang}
+			out := t.TempDir()
+			files, err := GenerateLocalizations(wixFile, out)
+			require.NoError(t, err)
+			require.Equal(t, []string{filepath.Join(out, test.file)}, files)
+			byt, err := ioutil.ReadFile(files[0])
+			require.NoError(t, err)
+			for _, want := range test.wants {
+				require.Contains(t, string(byt), want)
+			}
+		})
+	}
+
+	wixFile.Languages = nil
+	files, err := GenerateLocalizations(wixFile, t.TempDir())
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
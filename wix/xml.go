@@ -0,0 +1,129 @@
+package wix
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FormatXML indents the elements of a WiX source by two spaces, one per
+// line. The prefixes, comments and preprocessor instructions are kept,
+// blank text is dropped.
+func FormatXML(src []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(src))
+	var b bytes.Buffer
+	depth := 0
+	open := false   // a start tag is not closed yet
+	inline := false // the element has text, its end tag stays on its line
+	newline := func() {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(strings.Repeat("  ", depth))
+	}
+	closeStart := func() {
+		if open {
+			b.WriteString(">")
+			open = false
+		}
+	}
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			closeStart()
+			newline()
+			b.WriteString("<" + xmlName(t.Name))
+			for _, attr := range t.Attr {
+				b.WriteString(" " + xmlName(attr.Name) + `="` + attrEscaper.Replace(attr.Value) + `"`)
+			}
+			open, inline = true, false
+			depth++
+		case xml.EndElement:
+			depth--
+			if open {
+				b.WriteString("/>")
+				open = false
+				continue
+			}
+			if !inline {
+				newline()
+			}
+			b.WriteString("</" + xmlName(t.Name) + ">")
+			inline = false
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" {
+				continue
+			}
+			closeStart()
+			b.WriteString(textEscaper.Replace(text))
+			inline = true
+		case xml.Comment:
+			closeStart()
+			newline()
+			b.WriteString("<!--" + strings.ReplaceAll(string(t), "\r\n", "\n") + "-->")
+		case xml.ProcInst:
+			closeStart()
+			newline()
+			b.WriteString("<?" + t.Target)
+			if len(t.Inst) > 0 {
+				b.WriteString(" " + string(t.Inst))
+			}
+			b.WriteString("?>")
+		case xml.Directive:
+			closeStart()
+			newline()
+			b.WriteString("<!" + string(t) + ">")
+		}
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;",
+		"\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func xmlName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// ValidateXML checks that a WiX source is well formed and that its root
+// element is Wix, or WixLocalization for a localization file.
+func ValidateXML(src []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(src))
+	root := ""
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if t, ok := tok.(xml.StartElement); ok && root == "" {
+			root = t.Name.Local
+		}
+	}
+	switch root {
+	case "Wix", "WixLocalization":
+		return nil
+	case "":
+		return fmt.Errorf("no root element")
+	}
+	return fmt.Errorf("invalid root element %s, must be Wix or WixLocalization", root)
+}